@@ -6,6 +6,7 @@ require (
 	github.com/alphadose/haxmap v1.4.1
 	github.com/gabriel-vasile/mimetype v1.4.7
 	golang.org/x/exp v0.0.0-20241204233417-43b7b7cde48d
+	golang.org/x/time v0.10.0
 )
 
 require golang.org/x/net v0.32.0 // indirect
@@ -0,0 +1,221 @@
+package godl
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// compressedTypes lists MIME types whose content is already compressed, so
+// that compressing it again is pointless. Audio and video types are listed
+// individually, since formats such as WAV and AIFF usually hold uncompressed
+// samples that compress well.
+var compressedTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/vnd.rar",
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"audio/mpeg",
+	"audio/mp4",
+	"audio/x-m4a",
+	"audio/aac",
+	"audio/ogg",
+	"audio/opus",
+	"audio/webm",
+	"audio/flac",
+	"audio/x-flac",
+	"audio/amr",
+	"video/mp4",
+	"video/mpeg",
+	"video/webm",
+	"video/ogg",
+	"video/quicktime",
+	"video/x-matroska",
+	"video/x-flv",
+	"video/3gpp",
+	"video/3gpp2",
+}
+
+// Encoding is a content coding that can be applied to responses.
+type Encoding struct {
+	// Name is the content coding token used in the Accept-Encoding and
+	// Content-Encoding headers, such as "gzip".
+	Name string
+	// NewWriter returns a writer that encodes everything written to it and
+	// writes the result to w. Closing it must flush any buffered data.
+	NewWriter func(w io.Writer) io.WriteCloser
+}
+
+var (
+	// Gzip is the gzip content coding.
+	Gzip = Encoding{
+		Name:      "gzip",
+		NewWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	}
+
+	// Deflate is the deflate content coding, which denotes the zlib format.
+	Deflate = Encoding{
+		Name:      "deflate",
+		NewWriter: func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	}
+)
+
+// ServeDownloadCompressed serves a file like ServeDownload, but compresses
+// the response if the client accepts one of the configured encodings. The
+// encoding is negotiated using the q-values of the Accept-Encoding header,
+// with ties resolved by the order of preference given to WithEncodings. If no
+// encoding is acceptable, the file is served unencoded. The file is served
+// uncompressed if a Content-Encoding header has already been set, for
+// example by an outer handler, or if its content type denotes content that is
+// already compressed, such as gzip archives or JPEG images. This prevents the
+// response from being encoded twice. Files smaller than the size configured
+// WithMinCompressSize are also served uncompressed.
+//
+// Compressed responses do not support range requests, which they indicate
+// with an Accept-Ranges header of "none".
+func ServeDownloadCompressed(w http.ResponseWriter, r *http.Request, path string, name string, inlineTypes []string, infer func(string) string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+	o.apply(w, r, path, name)
+
+	SetContentType(w, path, infer)
+
+	o.setDisposition(w, r, o.downloadDisposition(w, inlineTypes), name)
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	enc, ok := negotiateEncoding(r, o.encodings)
+	if !ok ||
+		w.Header().Get("Content-Encoding") != "" ||
+		isCompressed(w.Header().Get("Content-Type")) ||
+		o.tooSmallToCompress(path) {
+		http.ServeFile(w, r, path)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		o.serveError(w, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		o.serveError(w, err)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if etag := w.Header().Get("ETag"); etag != "" && !isWeak(etag) {
+		// A strong entity tag must differ between encodings.
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+enc.Name+`"`)
+	}
+	// Content-MD5 and Repr-Digest cover the unencoded file only.
+	w.Header().Del("Content-MD5")
+	w.Header().Del("Repr-Digest")
+
+	if checkPreconditions(w, r, fi.ModTime()) {
+		return
+	}
+
+	w.Header().Set("Content-Encoding", enc.Name)
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	ew := enc.NewWriter(w)
+	defer ew.Close()
+	_, err = o.copy(r.Context(), ew, o.limit(f))
+	o.overrun(r, err)
+}
+
+// tooSmallToCompress reports whether the file specified by the given path is
+// smaller than the size configured WithMinCompressSize.
+func (o options) tooSmallToCompress(path string) bool {
+	if o.minCompressSize <= 0 {
+		return false
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() < o.minCompressSize
+}
+
+// isCompressed reports whether the given MIME type denotes content that is
+// already compressed.
+func isCompressed(m string) bool {
+	if mt, _, err := mime.ParseMediaType(m); err == nil {
+		m = mt
+	}
+	for _, ct := range compressedTypes {
+		if ct == m {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding selects the encoding with the highest q-value in the
+// request's Accept-Encoding header among the given encodings, preferring
+// earlier encodings on ties. A "*" element applies to all encodings not listed
+// explicitly. It reports false if no encoding is acceptable.
+func negotiateEncoding(r *http.Request, encodings []Encoding) (Encoding, bool) {
+	qs := map[string]float64{}
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		c, params, _ := strings.Cut(field, ";")
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			qs[c] = qvalue(params)
+		}
+	}
+
+	var best Encoding
+	bestQ := 0.0
+	for _, enc := range encodings {
+		q, ok := qs[strings.ToLower(enc.Name)]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+
+	return best, bestQ > 0
+}
+
+// qvalue returns the q-value among the given parameters of a header field
+// element, which defaults to 1. Malformed q-values are treated as 0.
+func qvalue(params string) float64 {
+	for _, p := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(k, "q") {
+			q, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0
+			}
+			return q
+		}
+	}
+	return 1
+}
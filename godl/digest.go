@@ -0,0 +1,141 @@
+package godl
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestKey identifies a cached digest of a file.
+type digestKey struct {
+	path string
+	alg  string
+}
+
+// digestEntry is a cached digest of a file, which is valid as long as the
+// file's size and modification time are unchanged.
+type digestEntry struct {
+	size    int64
+	modtime time.Time
+	sum     []byte
+}
+
+// digestCache caches digests of files by path and algorithm.
+var digestCache struct {
+	sync.Mutex
+	m map[digestKey]digestEntry
+}
+
+// fileDigest returns the hash of the content of the file specified by the
+// given path, computed by the hash returned by newHash. Since computing it
+// requires reading the whole file, the result is cached under the given
+// algorithm name until the file's size or modification time changes.
+func fileDigest(path string, alg string, newHash func() hash.Hash) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := digestKey{path: path, alg: alg}
+	digestCache.Lock()
+	e, ok := digestCache.m[key]
+	digestCache.Unlock()
+	if ok && e.size == fi.Size() && e.modtime.Equal(fi.ModTime()) {
+		return e.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+
+	digestCache.Lock()
+	if digestCache.m == nil {
+		digestCache.m = make(map[digestKey]digestEntry)
+	}
+	digestCache.m[key] = digestEntry{size: fi.Size(), modtime: fi.ModTime(), sum: sum}
+	digestCache.Unlock()
+
+	return sum, nil
+}
+
+// ContentMD5 returns the base64 encoded MD5 hash of the content of the file
+// specified by the given path, formatted for use in a Content-MD5 header as
+// defined by RFC 1864. Since computing it requires reading the whole file,
+// the result is cached until the file's size or modification time changes.
+func ContentMD5(path string) (string, error) {
+	sum, err := fileDigest(path, "md5", md5.New)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// digestAlgorithms maps the digest algorithms supported for the Repr-Digest
+// header to their hash functions.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// ReprDigest returns the digest of the content of the file specified by the
+// given path, computed with the given algorithm, which is either "sha-256" or
+// "sha-512", and formatted as a member of the Repr-Digest header defined by
+// RFC 9530, such as "sha-256=:<base64>:". Digests are cached like those
+// returned by ContentMD5.
+func ReprDigest(path string, alg string) (string, error) {
+	newHash, ok := digestAlgorithms[alg]
+	if !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	sum, err := fileDigest(path, alg, newHash)
+	if err != nil {
+		return "", err
+	}
+	return alg + "=:" + base64.StdEncoding.EncodeToString(sum) + ":", nil
+}
+
+// negotiateDigest returns the supported digest algorithm most preferred by
+// the given Want-Repr-Digest header, whose members weight algorithms from 1
+// to 10, with 0 marking an algorithm as not acceptable. If the header is
+// empty, sha-256 is chosen. It reports false if no supported algorithm is
+// acceptable. Ties are resolved in favor of sha-256.
+func negotiateDigest(want string) (string, bool) {
+	if strings.TrimSpace(want) == "" {
+		return "sha-256", true
+	}
+
+	var best string
+	var bestWeight int64
+	for _, member := range strings.Split(want, ",") {
+		alg, weight, _ := strings.Cut(strings.TrimSpace(member), "=")
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		if _, ok := digestAlgorithms[alg]; !ok {
+			continue
+		}
+		w, err := strconv.ParseInt(strings.TrimSpace(weight), 10, 64)
+		if err != nil || w <= 0 {
+			continue
+		}
+		if w > bestWeight || (w == bestWeight && alg == "sha-256") {
+			best, bestWeight = alg, w
+		}
+	}
+	return best, best != ""
+}
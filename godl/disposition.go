@@ -0,0 +1,199 @@
+package godl
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ScriptableTypes lists MIME types whose content can run scripts when a
+// browser displays it, which makes serving untrusted files of these types
+// inline prone to cross-site scripting. It is intended for use with
+// WithAlwaysAttachment.
+var ScriptableTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+	"text/javascript",
+	"application/javascript",
+}
+
+// Disposition is a disposition type of the Content-Disposition header.
+type Disposition string
+
+const (
+	// Inline indicates that the file should be displayed by the client.
+	Inline Disposition = "inline"
+	// Attachment indicates that the file should be downloaded by the client.
+	Attachment Disposition = "attachment"
+	// FormData indicates that the file is a field of a multipart/form-data
+	// body, which is useful for clients that re-upload downloaded files.
+	FormData Disposition = "form-data"
+)
+
+// DownloadParam is the query parameter read by DispositionFromRequest.
+const DownloadParam = "download"
+
+// DispositionFromRequest returns the disposition requested by the client
+// through the DownloadParam query parameter, as done by
+// DispositionFromParam.
+func DispositionFromRequest(r *http.Request) Disposition {
+	return DispositionFromParam(r, DownloadParam)
+}
+
+// DispositionFromParam returns Attachment if the query of the request
+// includes the given parameter without a value or with a value that
+// strconv.ParseBool considers true, such as "?download" or "?download=1", and
+// Inline otherwise. Values that are not booleans are treated like an empty
+// value. The result can be passed to the serve functions WithDisposition.
+func DispositionFromParam(r *http.Request, param string) Disposition {
+	q := r.URL.Query()
+	if !q.Has(param) {
+		return Inline
+	}
+
+	if b, err := strconv.ParseBool(q.Get(param)); err == nil && !b {
+		return Inline
+	}
+	return Attachment
+}
+
+// setDisposition sets the Content-Disposition header with the given type,
+// unless a different type is returned by the function configured
+// WithDispositionFunc for the request or configured WithDisposition. An empty
+// type sets no header, unless the options are configured WithExplicitInline.
+// Inline types also set the headers configured WithInlineCSP and
+// WithHTMLSandbox.
+func (o options) setDisposition(w http.ResponseWriter, r *http.Request, d Disposition, name string) {
+	if o.disposition != "" {
+		d = o.disposition
+	}
+	if o.dispositionFunc != nil {
+		if fd := o.dispositionFunc(r); fd != "" {
+			d = fd
+		}
+	}
+	if o.forcedAttachment(w.Header().Get("Content-Type")) {
+		d = Attachment
+	}
+	if d == "" && o.explicitInline {
+		d = Inline
+	}
+	if o.addExtension {
+		name = NameWithExtension(name, w.Header().Get("Content-Type"))
+	}
+	if d != "" {
+		setDisposition(w, d, name, o.fieldName)
+	}
+	if o.inlineCSP != "" && (d == "" || d == Inline) {
+		w.Header().Set("Content-Security-Policy", o.inlineCSP)
+	}
+	if o.htmlSandbox && (d == "" || d == Inline) && isHTML(w.Header().Get("Content-Type")) {
+		w.Header().Add("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+}
+
+// isHTML reports whether the given MIME type denotes an HTML document.
+func isHTML(m string) bool {
+	mt, _, _ := mime.ParseMediaType(m)
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// SetDisposition sets the Content-Disposition header to the given
+// disposition type, specifying the name of the file. File names that are not
+// plain ASCII are encoded as described by RFC 2231. For FormData, the field
+// name is "file".
+func SetDisposition(w http.ResponseWriter, d Disposition, name string) {
+	setDisposition(w, d, name, "file")
+}
+
+// SetAttachment sets the Content-Disposition header to inform the client
+// that the file is an attachment, specifying the name of the file. It is
+// equivalent to SetDisposition with Attachment.
+func SetAttachment(w http.ResponseWriter, name string) {
+	SetDisposition(w, Attachment, name)
+}
+
+// SetInline sets the Content-Disposition header to inform the client that
+// the file should be displayed inline, specifying the name of the file. It is
+// equivalent to SetDisposition with Inline.
+func SetInline(w http.ResponseWriter, name string) {
+	SetDisposition(w, Inline, name)
+}
+
+// ParseContentDisposition parses the value of a Content-Disposition header,
+// such as one set by SetDisposition, into its disposition type and file name.
+// The type is returned in lower case. A file name given as an RFC 2231
+// extended filename* parameter, as set for names that are not plain ASCII, is
+// decoded and takes precedence over a plain filename parameter. If the header has no file
+// name, an empty name is returned. An error is returned if the header is
+// malformed.
+func ParseContentDisposition(header string) (Disposition, string, error) {
+	d, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", "", err
+	}
+	return Disposition(d), params["filename"], nil
+}
+
+// setDisposition sets the Content-Disposition header to the given
+// disposition type with the given file name, and with the given field name if
+// the type is FormData. The header is formatted by mime.FormatMediaType, which
+// quotes the parameters as needed and encodes names that are not plain ASCII
+// as RFC 2231 parameters such as filename*.
+func setDisposition(w http.ResponseWriter, d Disposition, name string, field string) {
+	params := map[string]string{"filename": name}
+	if d == FormData {
+		params["name"] = field
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(string(d), params))
+}
+
+// downloadDisposition returns the disposition type of a file served by
+// ServeDownload and similar functions: Attachment if the file is not inline,
+// and otherwise an empty type, for which no header is set by default.
+func (o options) downloadDisposition(w http.ResponseWriter, inlineTypes []string) Disposition {
+	if o.isInline(w, inlineTypes) {
+		return ""
+	}
+	return Attachment
+}
+
+// isInline reports whether the Content-Type already set on the response is
+// one of the inline types. If the list is empty, all types are inline. Types
+// configured WithAlwaysAttachment are never inline.
+func (o options) isInline(w http.ResponseWriter, inlineTypes []string) bool {
+	ct := w.Header().Get("Content-Type")
+	if o.forcedAttachment(ct) {
+		return false
+	}
+
+	if len(inlineTypes) == 0 {
+		return true
+	}
+	for _, it := range inlineTypes {
+		if it == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// forcedAttachment reports whether the given content type is one of the
+// types configured WithAlwaysAttachment, ignoring its parameters.
+func (o options) forcedAttachment(ct string) bool {
+	m := ct
+	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		m = mt
+	}
+	for _, at := range o.alwaysAttachment {
+		if strings.EqualFold(at, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package godl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ETagMode selects how entity tags are computed.
+type ETagMode int
+
+const (
+	// Weak computes weak entity tags from the size and modification time of
+	// a file. They are cheap to compute, but only indicate that two versions
+	// of a file are semantically equivalent.
+	Weak ETagMode = iota
+	// Strong computes strong entity tags from a hash of the content of a
+	// file, which requires reading the whole file.
+	Strong
+)
+
+// ETag returns the entity tag of the file specified by the given path,
+// computed with the given mode and formatted for use in an ETag header. Weak
+// entity tags have the form W/"<size>-<modtime>", strong ones contain the
+// SHA-256 hash of the file's content.
+//
+// Both kinds are deterministic: an unchanged file always yields the same
+// entity tag, which clients rely on to resume downloads. A weak entity tag
+// changes whenever the file's size or modification time changes, even if its
+// content does not, while a strong one changes exactly when the content
+// changes. Note that If-Range requires a strong comparison, so a download can
+// only be resumed with If-Range and an entity tag if it is strong; with a weak
+// one the full file is served instead, and clients should send the
+// Last-Modified date in If-Range. The hash of a strong entity tag is cached
+// until the file's size or modification time changes, so that conditional
+// and HEAD requests do not read the whole file again.
+func ETag(path string, mode ETagMode) (string, error) {
+	if mode == Strong {
+		sum, err := fileDigest(path, "sha-256", sha256.New)
+		if err != nil {
+			return "", err
+		}
+		return `"` + base64.RawURLEncoding.EncodeToString(sum) + `"`, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return `W/"` + strconv.FormatInt(fi.Size(), 16) + "-" + strconv.FormatInt(fi.ModTime().UnixNano(), 16) + `"`, nil
+}
+
+// SetETag sets the ETag header for the file specified by the given path,
+// computed with the given mode.
+func SetETag(w http.ResponseWriter, path string, mode ETagMode) error {
+	etag, err := ETag(path, mode)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+// CombinedETag returns a weak entity tag derived from the names, sizes and
+// modification times of the files specified by the given paths, which
+// changes whenever one of the files changes. It is suitable for content
+// generated from these files, as served by ServeGenerated.
+func CombinedETag(paths ...string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.FormatInt(fi.Size(), 16) + "-" + strconv.FormatInt(fi.ModTime().UnixNano(), 16)))
+		h.Write([]byte{0})
+	}
+	return `W/"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// isWeak reports whether the given entity tag is weak.
+func isWeak(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// etagMatch compares two entity tags. If strong is true, it uses the strong
+// comparison of RFC 7232, under which both tags must be strong and identical.
+// Otherwise it uses the weak comparison, which ignores the weakness of the
+// tags.
+func etagMatch(a, b string, strong bool) bool {
+	if strong {
+		return !isWeak(a) && !isWeak(b) && a == b
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// etagListMatch reports whether the entity tag matches the value of an
+// If-Match or If-None-Match header, which is either "*" or a list of entity
+// tags. An empty header never matches.
+func etagListMatch(header, etag string, strong bool) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || (t != "" && etagMatch(t, etag, strong)) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified replies to a request whose If-None-Match header matched.
+// As required by RFC 7232, GET and HEAD requests receive a 304 Not Modified
+// response, while other methods receive 412 Precondition Failed.
+func writeNotModified(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// checkPreconditions evaluates the conditional headers of the request
+// against the ETag header already set on the response and the given
+// modification time, in the order specified by RFC 7232. If a precondition
+// fails, it replies with 412 Precondition Failed or 304 Not Modified and
+// reports true, in which case the caller must not write a body.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	etag := w.Header().Get("ETag")
+	modtime = modtime.Truncate(time.Second)
+
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatch(im, etag, true) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && !modtime.IsZero() {
+		if modtime.After(t) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatch(inm, etag, false) {
+			writeNotModified(w, r)
+			return true
+		}
+	} else if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modtime.IsZero() && !modtime.After(t) {
+			writeNotModified(w, r)
+			return true
+		}
+	}
+
+	return false
+}
@@ -4,87 +4,400 @@
 package godl
 
 import (
-	"mime"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
 	"net/http"
-	"net/url"
-	"path/filepath"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/gabriel-vasile/mimetype"
 )
 
-// Infer returns the MIME type of the file specified by the given path. It
-// first attempts to determine the MIME type using InferByMagic, and if
-// unsuccessful, it falls back to InferByExtension.
-func Infer(path string) string {
-	m := InferByMagic(path)
-	if m == "" {
-		return InferByExtension(path)
-	}
-	return m
+// ServeAttachment serves a file with the specified name and path, setting
+// the Content-Type header using the provided infer function and marking it as
+// an attachment by setting the Content-Disposition header.
+func ServeAttachment(w http.ResponseWriter, r *http.Request, path string, name string, infer func(string) string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+	o.apply(w, r, path, name)
+	SetContentType(w, path, infer)
+	o.setDisposition(w, r, Attachment, name)
+	http.ServeFile(w, r, path)
+}
+
+// ServeInline serves a file with the specified name and path, setting the
+// Content-Type header using the provided infer function and marking it to be
+// displayed inline by setting the Content-Disposition header, regardless of
+// its content type.
+func ServeInline(w http.ResponseWriter, r *http.Request, path string, name string, infer func(string) string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+	o.apply(w, r, path, name)
+	SetContentType(w, path, infer)
+	o.setDisposition(w, r, Inline, name)
+	http.ServeFile(w, r, path)
+}
+
+// ServeForceDownload serves a file with the specified name and path so that
+// browsers download it rather than render it, even for content types they
+// would otherwise display. Instead of the inferred type, it sets the
+// Content-Type header to application/octet-stream, marks the file as an
+// attachment and sets the X-Content-Type-Options header to "nosniff". Options
+// that change the disposition, such as WithDisposition, are ignored.
+func ServeForceDownload(w http.ResponseWriter, r *http.Request, path string, name string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+	o.apply(w, r, path, name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	setDisposition(w, Attachment, name, "")
+	http.ServeFile(w, r, path)
 }
 
-// InferByExtension returns the MIME type of the file specified by the given
-// path using the file extension, or an empty string if no match is found.
-func InferByExtension(path string) string {
-	return mime.TypeByExtension(filepath.Ext(path))
+// ServeDownload serves a file with the specified name and path, setting the
+// Content-Type header using the provided infer function and determining
+// whether to show the file inline based on the list of inline types. If the
+// list is empty, all content types are treated as inline, except for those
+// configured WithAlwaysAttachment. Additionally, it sets the
+// Content-Disposition header accordingly.
+func ServeDownload(w http.ResponseWriter, r *http.Request, path string, name string, inlineTypes []string, infer func(string) string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+	o.apply(w, r, path, name)
+	SetContentType(w, path, infer)
+
+	o.setDisposition(w, r, o.downloadDisposition(w, inlineTypes), name)
+
+	http.ServeFile(w, r, path)
 }
 
-// InferByMagic returns the MIME type of the file specified by the given
-// path using the mimetype module, or an empty string if no match is found.
-func InferByMagic(path string) string {
-	if m, err := mimetype.DetectFile(path); err == nil {
-		return m.String()
+// ServeDownloadTemplate serves a file like ServeDownload, with a name
+// rendered per request by executing the given template with the given data,
+// so that the same file can be downloaded under different names, such as
+// "invoice-{{.UserID}}.pdf". The rendered name is sanitized as done by
+// RenderName. If the template cannot be executed or renders an empty name,
+// the request is answered with 500 Internal Server Error.
+func ServeDownloadTemplate(w http.ResponseWriter, r *http.Request, path string, tmpl *template.Template, data any, inlineTypes []string, infer func(string) string, opts ...Option) {
+	name, err := RenderName(tmpl, data)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
 	}
-	return ""
+	ServeDownload(w, r, path, name, inlineTypes, infer, opts...)
 }
 
-// SetContentType sets the Content-Type header for the file specified by the
-// given path, inferred using the provided infer function.
-func SetContentType(w http.ResponseWriter, path string, infer func(string) string) {
-	m := infer(path)
-	if m == "" {
-		m = "application/octet-stream"
+// RenderName executes the given template with the given data and returns
+// the result as a file name suitable for Content-Disposition headers. Since
+// the data may come from users, control characters such as line breaks, which
+// could otherwise be used to inject headers, are removed, as are path
+// separators, and surrounding white space is trimmed. An error is returned if
+// the template cannot be executed or the sanitized name is empty.
+func RenderName(tmpl *template.Template, data any) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == '\\' {
+			return -1
+		}
+		return r
+	}, b.String()))
+	if name == "" {
+		return "", errors.New("godl: rendered file name is empty")
+	}
+	return name, nil
+}
+
+// ServeReader serves the content of rs with the given name and modification
+// time, determining whether to show it inline based on the list of inline
+// types like ServeDownload. The Content-Type header is set to the MIME type
+// detected from the leading bytes of the content, after which rs is rewound.
+// If detection yields application/octet-stream and infer is not nil, infer is
+// called with the name, such as InferByExtension, and its result is used
+// unless it is empty. Range and conditional requests are handled by
+// http.ServeContent, which seeks rs as needed. Headers derived from local
+// files, such as the one set WithETag, are not set.
+func ServeReader(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, rs io.ReadSeeker, inlineTypes []string, infer func(string) string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+	o.serveReader(w, r, name, modtime, rs, inlineTypes, infer)
+}
+
+// serveReader implements ServeReader with a writer that has already been
+// wrapped.
+func (o options) serveReader(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, rs io.ReadSeeker, inlineTypes []string, infer func(string) string) {
+	o.apply(w, r, "", name)
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(rs, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		o.serveError(w, err)
+		return
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		o.serveError(w, err)
+		return
+	}
+
+	m := mimetype.Detect(head[:n]).String()
+	if m == "application/octet-stream" && infer != nil {
+		if im := infer(name); im != "" {
+			m = im
+		}
 	}
 	w.Header().Set("Content-Type", m)
+
+	o.setDisposition(w, r, o.downloadDisposition(w, inlineTypes), name)
+
+	http.ServeContent(w, r, name, modtime, rs)
 }
 
-// SetAttachment sets the Content-Disposition header to inform the client
-// that the file is an attachment, specifying the name of the file.
-func SetAttachment(w http.ResponseWriter, name string) {
-	w.Header().Set(
-		"Content-Disposition",
-		"attachment; filename*=UTF-8''"+url.QueryEscape(name),
-	)
+// ServeDownloadFS serves the file with the given path from the given file
+// system like ServeReader, without falling back to inference by name.
+//
+// ServeReader requires the file to implement io.Seeker. Files of file systems
+// that do not support seeking, such as those read from a compressed archive,
+// are buffered in memory if their size does not exceed the size configured
+// WithSeekBuffer; otherwise they are streamed with an Accept-Ranges header of
+// "none", and Range headers are ignored.
+func ServeDownloadFS(w http.ResponseWriter, r *http.Request, fsys fs.FS, path string, name string, inlineTypes []string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		o.serveError(w, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		o.serveError(w, err)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if rs, ok := f.(io.ReadSeeker); ok {
+		o.serveReader(w, r, name, fi.ModTime(), rs, inlineTypes, nil)
+		return
+	}
+
+	var content io.Reader = f
+	if fi.Size() <= o.seekBuffer {
+		b, err := io.ReadAll(io.LimitReader(f, o.seekBuffer+1))
+		if err != nil {
+			o.serveError(w, err)
+			return
+		}
+		if int64(len(b)) <= o.seekBuffer {
+			o.serveReader(w, r, name, fi.ModTime(), bytes.NewReader(b), inlineTypes, nil)
+			return
+		}
+		// The file grew beyond the buffer since it was stat'ed.
+		content = io.MultiReader(bytes.NewReader(b), f)
+	}
+
+	o.apply(w, r, "", name)
+	content, err = SetContentTypeFromReader(w, content)
+	if err != nil {
+		o.serveError(w, err)
+		return
+	}
+	o.setDisposition(w, r, o.downloadDisposition(w, inlineTypes), name)
+
+	w.Header().Set("Accept-Ranges", "none")
+	if checkPreconditions(w, r, fi.ModTime()) {
+		return
+	}
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = o.copy(r.Context(), w, o.limit(content))
+	o.overrun(r, err)
 }
 
-// ServeAttachment serves a file with the specified name and path, setting
-// the Content-Type header using the provided infer function and marking it as
-// an attachment by setting the Content-Disposition header.
-func ServeAttachment(w http.ResponseWriter, r *http.Request, path string, name string, infer func(string) string) {
+// ServeRange serves the bytes from start up to but excluding end of the
+// file specified by the given path, such as the first megabyte of a video as
+// a preview, regardless of any Range header of the request. The response has
+// status 200 OK and a Content-Length of end-start. The Content-Type header is
+// set using the provided infer function, and the Content-Disposition header
+// as done by ServeDownload with an empty list of inline types. Headers that
+// describe the whole file, such as the one set WithETag, are not set. If the
+// window is not within the file, or is larger than the limit configured
+// WithMaxBytes, the request is answered with 416 Range Not Satisfiable before
+// any content is sent. Since the window is fixed, the response has an
+// Accept-Ranges header of "none".
+func ServeRange(w http.ResponseWriter, r *http.Request, path string, start, end int64, name string, infer func(string) string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+
+	f, err := os.Open(path)
+	if err != nil {
+		o.serveError(w, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		o.serveError(w, err)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A window larger than the limit could not be served with a
+	// Content-Length of end-start.
+	if start < 0 || end < start || end > fi.Size() || (o.maxBytes > 0 && end-start > o.maxBytes) {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(fi.Size(), 10))
+		http.Error(w, "416 Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	o.apply(w, r, "", name)
 	SetContentType(w, path, infer)
-	SetAttachment(w, name)
-	http.ServeFile(w, r, path)
+	o.setDisposition(w, r, o.downloadDisposition(w, nil), name)
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		o.serveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = o.copy(r.Context(), w, o.limit(io.LimitReader(f, end-start)))
+	o.overrun(r, err)
 }
 
-// ServeDownload serves a file with the specified name and path, setting the
-// Content-Type header using the provided infer function and determining
-// whether to show the file inline based on the list of inline types. If the
-// list is empty, all content types are treated as inline. Additionally, it
-// sets the Content-Disposition header accordingly.
-func ServeDownload(w http.ResponseWriter, r *http.Request, path string, name string, inlineTypes []string, infer func(string) string) {
-	SetContentType(w, path, infer)
+// ServeGenerated serves content produced on demand by generate, such as an
+// archive assembled per request, as an attachment with the given name. The
+// Content-Type header is inferred from the name by InferName unless it has
+// already been set.
+//
+// Since the content cannot be validated without generating it, the caller
+// may pass an entity tag computed in advance, usually a weak one derived from
+// the inputs of the generation as done by CombinedETag. It is set as the ETag
+// header, and conditional requests are evaluated against it before generate
+// is called, so that cache hits are answered with 304 Not Modified without
+// generating anything. An empty entity tag disables this.
+//
+// If generate fails before writing anything, the request is answered with
+// 500 Internal Server Error; otherwise the response is cut short. Writes to
+// the writer passed to generate fail once the client has gone away. Range
+// requests are not supported, as indicated by an Accept-Ranges header of
+// "none".
+func ServeGenerated(w http.ResponseWriter, r *http.Request, name string, etag string, generate func(io.Writer) error, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+	o.apply(w, r, "", name)
 
-	inline := len(inlineTypes) == 0
-	for _, it := range inlineTypes {
-		if it == w.Header().Get("Content-Type") {
-			inline = true
-			break
-		}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", InferName(name))
+	}
+	o.setDisposition(w, r, Attachment, name)
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Accept-Ranges", "none")
+	if checkPreconditions(w, r, time.Time{}) {
+		return
 	}
 
-	if !inline {
-		SetAttachment(w, name)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
-	http.ServeFile(w, r, path)
+	gw := &generatedWriter{ctx: r.Context(), w: w, limit: o.maxBytes}
+	if err := generate(gw); err != nil && !gw.wrote {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+	if gw.exceeded {
+		o.overrun(r, ErrMaxBytesExceeded)
+	}
+}
+
+// generatedWriter is the writer passed to the generate function of
+// ServeGenerated, which records whether anything was written and enforces the
+// limit configured WithMaxBytes, if any.
+type generatedWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	wrote    bool
+	limit    int64
+	n        int64
+	exceeded bool
+}
+
+// Write writes p to the response unless the context is done, in which case
+// it returns the context's error. If p exceeds the limit, only the bytes up to
+// the limit are written and ErrMaxBytesExceeded is returned.
+func (gw *generatedWriter) Write(p []byte) (int, error) {
+	if err := gw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if gw.limit > 0 && gw.n+int64(len(p)) > gw.limit {
+		gw.exceeded = true
+		n, err := gw.write(p[:gw.limit-gw.n])
+		if err == nil {
+			err = ErrMaxBytesExceeded
+		}
+		return n, err
+	}
+	return gw.write(p)
+}
+
+// write writes p to the response and counts the bytes written.
+func (gw *generatedWriter) write(p []byte) (int, error) {
+	gw.wrote = true
+	n, err := gw.w.Write(p)
+	gw.n += int64(n)
+	return n, err
+}
+
+// serveError replies to the request with an HTTP error matching the given
+// error from opening or reading a file.
+func serveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
 }
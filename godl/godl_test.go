@@ -0,0 +1,1296 @@
+package godl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+	"time"
+)
+
+// writeFile writes the given content to a file with the given name in a
+// temporary directory and returns its path.
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveRequest records the response of a serve function for the given
+// request.
+func serveRequest(r *http.Request, f func(w http.ResponseWriter, r *http.Request)) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	f(rec, r)
+	return rec
+}
+
+// withHeader returns a GET request with the given target and header.
+func withHeader(target string, key, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set(key, value)
+	return r
+}
+
+// compressible is content large enough to be compressed by default.
+var compressible = strings.Repeat("hello world\n", 200)
+
+func TestCompressedSkipsEncodedContent(t *testing.T) {
+	text := writeFile(t, "big.txt", compressible)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(compressible))
+	_ = zw.Close()
+	archive := writeFile(t, "big.gz", gz.String())
+
+	rec := serveRequest(withHeader("/", "Accept-Encoding", "gzip"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		ServeDownloadCompressed(w, r, text, "big.txt", nil, Infer)
+	})
+	if rec.Body.String() != compressible {
+		t.Error("response with a Content-Encoding compressed again")
+	}
+
+	rec = serveRequest(withHeader("/", "Accept-Encoding", "gzip"), func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadCompressed(w, r, archive, "big.gz", nil, Infer)
+	})
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != gz.String() {
+		t.Error("compressed file type compressed again")
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     bool
+	}{
+		{"application/gzip", true},
+		{"audio/mpeg", true},
+		{"video/mp4; codecs=avc1", true},
+		{"audio/wav", false},
+		{"audio/x-wav", false},
+		{"audio/aiff", false},
+		{"audio/x-aiff", false},
+		{"text/plain; charset=utf-8", false},
+	}
+	for _, tt := range tests {
+		if got := isCompressed(tt.mimeType); got != tt.want {
+			t.Errorf("isCompressed(%q) = %v, want %v", tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestCompressedText(t *testing.T) {
+	path := writeFile(t, "big.txt", compressible)
+
+	rec := serveRequest(withHeader("/", "Accept-Encoding", "gzip;q=0.5"), func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadCompressed(w, r, path, "big.txt", nil, Infer)
+	})
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != compressible {
+		t.Error("decompressed body differs from the file")
+	}
+
+	rec = serveRequest(withHeader("/", "Accept-Encoding", "gzip;q=0"), func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadCompressed(w, r, path, "big.txt", nil, Infer)
+	})
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Error("response compressed although gzip is disabled by q=0")
+	}
+}
+
+// identityEncoding is a content coding that leaves content unchanged.
+var identityEncoding = Encoding{
+	Name: "br",
+	NewWriter: func(w io.Writer) io.WriteCloser {
+		return nopWriteCloser{w}
+	},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestNegotiateEncoding(t *testing.T) {
+	path := writeFile(t, "big.txt", compressible)
+
+	tests := []struct {
+		accept string
+		opts   []Option
+		want   string
+	}{
+		{"gzip", nil, "gzip"},
+		{"gzip;q=0.5, deflate", nil, "deflate"},
+		{"deflate, gzip", nil, "gzip"},
+		{"*", nil, "gzip"},
+		{"*;q=0", nil, ""},
+		{"identity", nil, ""},
+		{"gzip, br", []Option{WithEncodings(identityEncoding, Gzip)}, "br"},
+	}
+	for _, tt := range tests {
+		rec := serveRequest(withHeader("/", "Accept-Encoding", tt.accept), func(w http.ResponseWriter, r *http.Request) {
+			ServeDownloadCompressed(w, r, path, "big.txt", nil, Infer, tt.opts...)
+		})
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Accept-Encoding %q: encoding = %q, want %q", tt.accept, got, tt.want)
+			continue
+		}
+
+		var body io.Reader = rec.Body
+		switch tt.want {
+		case "gzip":
+			body, _ = gzip.NewReader(rec.Body)
+		case "deflate":
+			body, _ = zlib.NewReader(rec.Body)
+		}
+		if b, err := io.ReadAll(body); err != nil || string(b) != compressible {
+			t.Errorf("Accept-Encoding %q: content does not round-trip: %v", tt.accept, err)
+		}
+	}
+}
+
+func TestStrongETagCached(t *testing.T) {
+	path := writeFile(t, "data.txt", "hello")
+
+	etag, err := ETag(path, Strong)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digestCache.Lock()
+	_, ok := digestCache.m[digestKey{path: path, alg: "sha-256"}]
+	digestCache.Unlock()
+	if !ok {
+		t.Fatal("strong entity tag not cached")
+	}
+
+	if err := os.WriteFile(path, []byte("hello, world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := ETag(path, Strong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == etag {
+		t.Errorf("entity tag %s unchanged after the file changed", etag)
+	}
+}
+
+func TestCompressedETagDiffersFromIdentity(t *testing.T) {
+	path := writeFile(t, "page.txt", strings.Repeat("compressible text ", 200))
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		ServeDownloadCompressed(rec, r, path, "page.txt", nil, Infer, WithETag(Strong))
+		return rec
+	}
+
+	identity, gzipped := get(""), get("gzip")
+	if gzipped.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("response not compressed")
+	}
+	ie, ge := identity.Header().Get("ETag"), gzipped.Header().Get("ETag")
+	if ie == "" || ge == "" {
+		t.Fatalf("missing entity tags %q and %q", ie, ge)
+	}
+	if ie == ge && !isWeak(ge) {
+		t.Errorf("compressed and identity responses share the strong entity tag %s", ge)
+	}
+
+	// The entity tag of the compressed representation validates it.
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", ge)
+	ServeDownloadCompressed(rec, r, path, "page.txt", nil, Infer, WithETag(Strong))
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	path := writeFile(t, "big.txt", compressible)
+
+	rec := serveRequest(withHeader("/", "If-Match", `"other"`), func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept-Encoding", "gzip")
+		ServeDownloadCompressed(w, r, path, "big.txt", nil, Infer, WithETag(Strong))
+	})
+	if rec.Code != http.StatusPreconditionFailed || rec.Body.Len() != 0 {
+		t.Errorf("status = %d with a mismatched If-Match, want 412", rec.Code)
+	}
+
+	since := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	rec = serveRequest(withHeader("/", "If-Unmodified-Since", since), func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept-Encoding", "gzip")
+		ServeDownloadCompressed(w, r, path, "big.txt", nil, Infer)
+	})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("status = %d for a file modified after If-Unmodified-Since, want 412", rec.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("If-None-Match", `W/"v1"`)
+	rec = serveRequest(r, func(w http.ResponseWriter, r *http.Request) {
+		ServeGenerated(w, r, "a.txt", `W/"v1"`, func(w io.Writer) error {
+			t.Error("content generated for a failed precondition")
+			return nil
+		})
+	})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("status = %d for a POST with a matching If-None-Match, want 412", rec.Code)
+	}
+}
+
+func TestServeStopsOnDisconnect(t *testing.T) {
+	path := writeFile(t, "a.txt", compressible)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := serveRequest(r, func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadCompressed(w, r, path, "a.txt", nil, Infer)
+	})
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); len(b) != 0 {
+		t.Errorf("%d bytes sent to a disconnected client", len(b))
+	}
+}
+
+// serve records the response of a serve function for a GET request with the
+// given target.
+func serve(t *testing.T, target string, f func(w http.ResponseWriter, r *http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	f(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestServeInline(t *testing.T) {
+	path := writeFile(t, "data.bin", "\x00\x01\x02\x03")
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeInline(w, r, path, "data.bin", Infer)
+	})
+	if got := rec.Header().Get("Content-Disposition"); got != "inline; filename=data.bin" {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if rec.Body.String() != "\x00\x01\x02\x03" {
+		t.Errorf("body = %q", rec.Body.String())
+	}
+}
+
+func TestSetAttachment(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "attachment; filename=report.pdf"},
+		{"my report.pdf", `attachment; filename="my report.pdf"`},
+		{"résumé.pdf", "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		SetAttachment(rec, tt.name)
+		if got := rec.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("SetAttachment(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlwaysAttachment(t *testing.T) {
+	path := writeFile(t, "page.html", "<html><script>alert(1)</script></html>")
+
+	for _, inlineTypes := range [][]string{nil, {"text/html; charset=utf-8"}} {
+		rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+			ServeDownload(w, r, path, "page.html", inlineTypes, Infer, WithAlwaysAttachment(ScriptableTypes...))
+		})
+		if got := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+			t.Errorf("inline types %q: Content-Disposition = %q, want an attachment", inlineTypes, got)
+		}
+	}
+}
+
+func TestFormDataDisposition(t *testing.T) {
+	path := writeFile(t, "a.txt", "hello")
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeAttachment(w, r, path, "a.txt", Infer, WithDisposition(FormData), WithFieldName("upload"))
+	})
+	if got, want := rec.Header().Get("Content-Disposition"), "form-data; filename=a.txt; name=upload"; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+}
+
+var pngHeader = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00"
+
+func TestInferDetailed(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "a.txt")
+	spoofed := filepath.Join(dir, "b.txt")
+	_ = os.WriteFile(text, []byte("hello"), 0o644)
+	_ = os.WriteFile(spoofed, []byte(pngHeader), 0o644)
+
+	tests := []struct {
+		path    string
+		want    InferResult
+		wantErr bool
+	}{
+		{text, InferResult{Type: "text/plain; charset=utf-8", Method: ByMagic, Agree: true}, false},
+		{spoofed, InferResult{Type: "image/png", Method: ByMagic}, false},
+		{filepath.Join(dir, "missing.pdf"), InferResult{Type: "application/pdf", Method: ByExtension}, false},
+		{filepath.Join(dir, "missing"), InferResult{}, true},
+	}
+	for _, tt := range tests {
+		got, err := InferDetailed(tt.path)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("InferDetailed(%s) = %+v, %v, want %+v", filepath.Base(tt.path), got, err, tt.want)
+		}
+	}
+}
+
+func TestSetContentTypeFromReader(t *testing.T) {
+	content := pngHeader + strings.Repeat("\x00", 4096)
+	rec := httptest.NewRecorder()
+	r, err := SetContentTypeFromReader(rec, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", ct)
+	}
+	if b, _ := io.ReadAll(r); string(b) != content {
+		t.Error("returned reader does not yield the whole content")
+	}
+}
+
+func TestWithExtension(t *testing.T) {
+	path := writeFile(t, "report", "%PDF-1.4\n")
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeAttachment(w, r, path, "report", Infer, WithExtension())
+	})
+	if got := rec.Header().Get("Content-Disposition"); got != "attachment; filename=report.pdf" {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	if got := NameWithExtension("notes.md", "text/plain"); got != "notes.md" {
+		t.Errorf("NameWithExtension = %q for a name with an extension", got)
+	}
+	if got := NameWithExtension("notes", "x-unknown/x-unknown"); got != "notes" {
+		t.Errorf("NameWithExtension = %q for an unknown type", got)
+	}
+}
+
+func TestServeRemoteRange(t *testing.T) {
+	modtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.txt":
+			http.ServeContent(w, r, "a.txt", modtime, strings.NewReader("hello world"))
+		case "/broken":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	remote := func(path string) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ServeRemote(w, r, upstream.Client(), upstream.URL+path, "a.txt", nil)
+		}
+	}
+
+	rec := serveRequest(withHeader("/", "Range", "bytes=6-10"), remote("/a.txt"))
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "world" {
+		t.Errorf("range response = %d %q, want 206 %q", rec.Code, rec.Body.String(), "world")
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 6-10/11" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q", got)
+	}
+
+	if rec := serve(t, "/", remote("/missing")); rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d for a missing upstream file, want 404", rec.Code)
+	}
+	if rec := serve(t, "/", remote("/broken")); rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d for a failing upstream server, want 502", rec.Code)
+	}
+}
+
+func TestImmutableNames(t *testing.T) {
+	path := writeFile(t, "app.js", "console.log(1)")
+	pattern := regexp.MustCompile(`\.[0-9a-f]{8}\.`)
+
+	for name, want := range map[string]string{
+		"app.3f2a9c1b.js": ImmutableCacheControl,
+		"app.js":          "no-cache",
+	} {
+		rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+			ServeDownload(w, r, path, name, nil, Infer, WithImmutableNames(pattern))
+		})
+		if got := rec.Header().Get("Cache-Control"); got != want {
+			t.Errorf("Cache-Control = %q for %s, want %q", got, name, want)
+		}
+	}
+}
+
+func TestDispositionFromParam(t *testing.T) {
+	tests := map[string]Disposition{
+		"/":                Inline,
+		"/?download":       Attachment,
+		"/?download=1":     Attachment,
+		"/?download=true":  Attachment,
+		"/?download=0":     Inline,
+		"/?download=false": Inline,
+		"/?download=maybe": Attachment,
+		"/?other=1":        Inline,
+	}
+	for target, want := range tests {
+		if got := DispositionFromRequest(httptest.NewRequest(http.MethodGet, target, nil)); got != want {
+			t.Errorf("DispositionFromRequest(%s) = %q, want %q", target, got, want)
+		}
+	}
+	if got := DispositionFromParam(httptest.NewRequest(http.MethodGet, "/?dl", nil), "dl"); got != Attachment {
+		t.Errorf("DispositionFromParam = %q, want %q", got, Attachment)
+	}
+}
+
+func TestContentMD5(t *testing.T) {
+	path := writeFile(t, "big.txt", compressible)
+	sum := md5.Sum([]byte(compressible))
+	want := base64.StdEncoding.EncodeToString(sum[:])
+
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeDownload(w, r, path, "big.txt", nil, Infer, WithContentMD5())
+	})
+	if got := rec.Header().Get("Content-MD5"); got != want {
+		t.Errorf("Content-MD5 = %q, want %q", got, want)
+	}
+
+	rec = serveRequest(withHeader("/", "Accept-Encoding", "gzip"), func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadCompressed(w, r, path, "big.txt", nil, Infer, WithContentMD5())
+	})
+	if got := rec.Header().Get("Content-MD5"); got != "" {
+		t.Errorf("Content-MD5 = %q for a compressed response", got)
+	}
+}
+
+func TestInferByMagicReader(t *testing.T) {
+	if got := InferByMagicReader(context.Background(), strings.NewReader(pngHeader), 0); got != "image/png" {
+		t.Errorf("type = %q, want image/png", got)
+	}
+	if got := InferByMagicReader(context.Background(), strings.NewReader(pngHeader), 4); got == "image/png" {
+		t.Errorf("type = %q detected from bytes beyond the limit", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r := make(blockingReader)
+	defer close(r)
+	if got := InferByMagicReader(ctx, r, 0); got != "application/octet-stream" {
+		t.Errorf("type = %q for a stalled reader, want application/octet-stream", got)
+	}
+}
+
+// blockingReader is a reader whose reads block until it is closed.
+type blockingReader chan struct{}
+
+func (r blockingReader) Read([]byte) (int, error) {
+	<-r
+	return 0, io.EOF
+}
+
+func TestExtensionFor(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+		ok       bool
+	}{
+		{"image/jpeg", ".jpg", true},
+		{"text/plain; charset=utf-8", ".txt", true},
+		{"application/pdf", ".pdf", true},
+		{"x-unknown/x-unknown", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := ExtensionFor(tt.mimeType); got != tt.want || ok != tt.ok {
+			t.Errorf("ExtensionFor(%q) = %q, %v, want %q, %v", tt.mimeType, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIfRangeRequiresStrongETag(t *testing.T) {
+	path := writeFile(t, "a.txt", "hello world")
+
+	for _, mode := range []ETagMode{Strong, Weak} {
+		download := func(w http.ResponseWriter, r *http.Request) {
+			ServeDownload(w, r, path, "a.txt", nil, Infer, WithETag(mode))
+		}
+		etag := serve(t, "/", download).Header().Get("ETag")
+
+		for ifRange, want := range map[string]int{etag: http.StatusPartialContent, `"stale"`: http.StatusOK} {
+			if mode == Weak {
+				want = http.StatusOK
+			}
+			r := withHeader("/", "Range", "bytes=0-4")
+			r.Header.Set("If-Range", ifRange)
+			if rec := serveRequest(r, download); rec.Code != want {
+				t.Errorf("mode %d: status = %d with If-Range %s, want %d", mode, rec.Code, ifRange, want)
+			}
+		}
+
+		if again := serve(t, "/", download).Header().Get("ETag"); again != etag {
+			t.Errorf("mode %d: entity tag changed from %s to %s", mode, etag, again)
+		}
+	}
+}
+
+func TestExplicitInline(t *testing.T) {
+	path := writeFile(t, "a.txt", "hello")
+	for _, tt := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, ""},
+		{[]Option{WithExplicitInline()}, "inline; filename=a.txt"},
+	} {
+		rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+			ServeDownload(w, r, path, "a.txt", nil, Infer, tt.opts...)
+		})
+		if got := rec.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("Content-Disposition = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestAlwaysAttachmentOverridesDispositionOptions(t *testing.T) {
+	path := writeFile(t, "page.html", "<html><script>alert(1)</script></html>")
+
+	tests := []struct {
+		name   string
+		target string
+		opts   []Option
+	}{
+		{"DispositionFunc", "/", []Option{WithDispositionFunc(DispositionFromRequest)}},
+		{"Disposition", "/", []Option{WithDisposition(Inline)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithAlwaysAttachment(ScriptableTypes...)}, tt.opts...)
+			rec := serve(t, tt.target, func(w http.ResponseWriter, r *http.Request) {
+				ServeDownload(w, r, path, "page.html", nil, Infer, opts...)
+			})
+			if cd := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") {
+				t.Errorf("Content-Disposition = %q, want an attachment", cd)
+			}
+		})
+	}
+}
+
+func TestPreload(t *testing.T) {
+	path := writeFile(t, "index.html", "<html></html>")
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeInline(w, r, path, "index.html", Infer, WithPreload("/style.css", "/app.js", "/font.woff2", "/logo.png?v=2", "/data"))
+	})
+	want := []string{
+		"</style.css>; rel=preload; as=style",
+		"</app.js>; rel=preload; as=script",
+		"</font.woff2>; rel=preload; as=font; crossorigin",
+		"</logo.png?v=2>; rel=preload; as=image",
+		"</data>; rel=preload",
+	}
+	if got := rec.Header().Values("Link"); !slices.Equal(got, want) {
+		t.Errorf("Link = %q, want %q", got, want)
+	}
+}
+
+func TestSetDisposition(t *testing.T) {
+	tests := []struct {
+		d    Disposition
+		name string
+		want string
+	}{
+		{Attachment, "report.pdf", "attachment; filename=report.pdf"},
+		{Inline, "résumé.pdf", "inline; filename*=utf-8''r%C3%A9sum%C3%A9.pdf"},
+		{FormData, "a.txt", "form-data; filename=a.txt; name=file"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		SetDisposition(rec, tt.d, tt.name)
+		if got := rec.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("Content-Disposition = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSentHash(t *testing.T) {
+	path := writeFile(t, "a.txt", "hello world")
+
+	tests := []struct {
+		name  string
+		r     *http.Request
+		wantN int64
+		want  string
+	}{
+		{"Full", httptest.NewRequest(http.MethodGet, "/", nil), 11, "hello world"},
+		{"Range", withHeader("/", "Range", "bytes=6-10"), 5, "world"},
+		{"Head", httptest.NewRequest(http.MethodHead, "/", nil), 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sum []byte
+			var n int64
+			serveRequest(tt.r, func(w http.ResponseWriter, r *http.Request) {
+				ServeDownload(w, r, path, "a.txt", nil, Infer, WithSentHash(func(s []byte, sn int64) { sum, n = s, sn }))
+			})
+			want := sha256.Sum256([]byte(tt.want))
+			if n != tt.wantN || !bytes.Equal(sum, want[:]) {
+				t.Errorf("sent hash = %x, %d, want %x, %d", sum, n, want, tt.wantN)
+			}
+		})
+	}
+}
+
+func TestInferName(t *testing.T) {
+	for name, want := range map[string]string{
+		"missing/report.pdf": "application/pdf",
+		"REPORT.PDF":         "application/pdf",
+		"noextension":        "application/octet-stream",
+	} {
+		if got := InferName(name); got != want {
+			t.Errorf("InferName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestServeGenerated(t *testing.T) {
+	a := writeFile(t, "a.txt", "a")
+	b := writeFile(t, "b.txt", "b")
+	etag, err := CombinedETag(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("CombinedETag = %s, want a weak entity tag", etag)
+	}
+	if other, _ := CombinedETag(b, a); other == etag {
+		t.Error("CombinedETag does not depend on the order of the files")
+	}
+
+	var generated int
+	generate := func(w io.Writer) error {
+		generated++
+		_, err := io.WriteString(w, "archive")
+		return err
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		ServeGenerated(w, r, "bundle.zip", etag, generate)
+	}
+
+	rec := serve(t, "/", handler)
+	if rec.Code != http.StatusOK || rec.Body.String() != "archive" || rec.Header().Get("ETag") != etag {
+		t.Errorf("response = %d %q with ETag %s", rec.Code, rec.Body.String(), rec.Header().Get("ETag"))
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/zip" {
+		t.Errorf("Content-Type = %q, want application/zip", got)
+	}
+
+	rec = serveRequest(withHeader("/", "If-None-Match", etag), handler)
+	if rec.Code != http.StatusNotModified || generated != 1 {
+		t.Errorf("status = %d after %d generations, want 304 after 1", rec.Code, generated)
+	}
+
+	rec = serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeGenerated(w, r, "bundle.zip", "", func(io.Writer) error { return errors.New("boom") })
+	})
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d for a failed generation, want 500", rec.Code)
+	}
+}
+
+func TestReprDigest(t *testing.T) {
+	path := writeFile(t, "a.txt", "hello")
+	sum256 := sha256.Sum256([]byte("hello"))
+	sum512 := sha512.Sum512([]byte("hello"))
+
+	tests := []struct {
+		want   string
+		digest string
+	}{
+		{"", "sha-256=:" + base64.StdEncoding.EncodeToString(sum256[:]) + ":"},
+		{"sha-512=3, sha-256=1", "sha-512=:" + base64.StdEncoding.EncodeToString(sum512[:]) + ":"},
+		{"sha-256=1, sha-512=1", "sha-256=:" + base64.StdEncoding.EncodeToString(sum256[:]) + ":"},
+		{"sha-256=0, md5=10", ""},
+	}
+	for _, tt := range tests {
+		rec := serveRequest(withHeader("/", "Want-Repr-Digest", tt.want), func(w http.ResponseWriter, r *http.Request) {
+			ServeDownload(w, r, path, "a.txt", nil, Infer, WithReprDigest())
+		})
+		if got := rec.Header().Get("Repr-Digest"); got != tt.digest {
+			t.Errorf("Want-Repr-Digest %q: Repr-Digest = %q, want %q", tt.want, got, tt.digest)
+		}
+		if !slices.Contains(rec.Header().Values("Vary"), "Want-Repr-Digest") {
+			t.Errorf("Want-Repr-Digest %q: Vary = %q", tt.want, rec.Header().Values("Vary"))
+		}
+	}
+
+	if _, err := ReprDigest(path, "md5"); err == nil {
+		t.Error("ReprDigest accepted an unsupported algorithm")
+	}
+}
+
+func TestServeRange(t *testing.T) {
+	path := writeFile(t, "a.txt", "hello world")
+
+	rec := serveRequest(withHeader("/", "Range", "bytes=0-0"), func(w http.ResponseWriter, r *http.Request) {
+		ServeRange(w, r, path, 2, 7, "a.txt", Infer)
+	})
+	if rec.Code != http.StatusOK || rec.Body.String() != "llo w" {
+		t.Errorf("response = %d %q, want 200 %q", rec.Code, rec.Body.String(), "llo w")
+	}
+	if rec.Header().Get("Content-Length") != "5" || rec.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("headers = %v", rec.Header())
+	}
+
+	for _, window := range [][2]int64{{-1, 2}, {5, 2}, {0, 12}} {
+		rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+			ServeRange(w, r, path, window[0], window[1], "a.txt", Infer)
+		})
+		if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */11" {
+			t.Errorf("window %v: status = %d, Content-Range = %q", window, rec.Code, rec.Header().Get("Content-Range"))
+		}
+	}
+}
+
+func TestBufferPoolReused(t *testing.T) {
+	p := bufferPool(4096)
+	if allocs := testing.AllocsPerRun(100, func() { bufferPool(4096) }); allocs != 0 {
+		t.Errorf("bufferPool allocated %v times for an existing pool, want 0", allocs)
+	}
+	if bufferPool(4096) != p {
+		t.Error("bufferPool returned a different pool for the same size")
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that discards the body and
+// does not implement io.ReaderFrom, like many wrapping middlewares.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func BenchmarkBufferSize(b *testing.B) {
+	const size = 8 << 20
+	path := filepath.Join(b.TempDir(), "data.bin")
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	for _, n := range []int{0, 4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			var opts []Option
+			if n > 0 {
+				opts = append(opts, WithBufferSize(n))
+			}
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for range b.N {
+				w := &discardResponseWriter{header: make(http.Header)}
+				ServeRange(w, r, path, 0, size, "data.bin", Infer, opts...)
+			}
+		})
+	}
+}
+
+func TestInferWith(t *testing.T) {
+	path := writeFile(t, "page.txt", "<html><body>hello</body></html>")
+
+	if got := InferWith(StdlibSniffer{})(path); got != "text/html; charset=utf-8" {
+		t.Errorf("StdlibSniffer type = %q", got)
+	}
+	if got := InferWith(MimetypeSniffer{})(path); got != "text/html; charset=utf-8" {
+		t.Errorf("MimetypeSniffer type = %q", got)
+	}
+	if got := InferWith(failingSniffer{})(path); got != "text/plain; charset=utf-8" {
+		t.Errorf("type = %q when sniffing fails, want the type of the extension", got)
+	}
+}
+
+// failingSniffer is a Sniffer that never detects anything.
+type failingSniffer struct{}
+
+func (failingSniffer) Sniff(string) (string, error)          { return "", errors.New("unsupported") }
+func (failingSniffer) SniffReader(io.Reader) (string, error) { return "", errors.New("unsupported") }
+
+func TestServeRangeMaxBytes(t *testing.T) {
+	path := writeFile(t, "data.bin", "0123456789")
+
+	tests := []struct {
+		name       string
+		max        int64
+		wantStatus int
+		wantBody   string
+	}{
+		{"WithinLimit", 4, http.StatusOK, "2345"},
+		{"BeyondLimit", 3, http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+				ServeRange(w, r, path, 2, 6, "data.bin", Infer, WithMaxBytes(tt.max))
+			})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if cl := rec.Header().Get("Content-Length"); tt.wantStatus == http.StatusOK && cl != "4" {
+				t.Errorf("Content-Length = %s, want 4", cl)
+			}
+		})
+	}
+}
+
+func TestServeDownloadFS(t *testing.T) {
+	fsys := fstest.MapFS{"a.txt": {Data: []byte("hello world"), ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}
+
+	tests := []struct {
+		name       string
+		fsys       fs.FS
+		opts       []Option
+		wantCode   int
+		wantBody   string
+		wantRanges string
+	}{
+		{"Seekable", fsys, nil, http.StatusPartialContent, "hello", "bytes"},
+		{"Buffered", unseekableFS{fsys}, nil, http.StatusPartialContent, "hello", "bytes"},
+		{"Streamed", unseekableFS{fsys}, []Option{WithSeekBuffer(0)}, http.StatusOK, "hello world", "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveRequest(withHeader("/", "Range", "bytes=0-4"), func(w http.ResponseWriter, r *http.Request) {
+				ServeDownloadFS(w, r, tt.fsys, "a.txt", "a.txt", nil, tt.opts...)
+			})
+			if rec.Code != tt.wantCode || rec.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", rec.Code, rec.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != tt.wantRanges {
+				t.Errorf("Accept-Ranges = %q, want %q", got, tt.wantRanges)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type = %q", got)
+			}
+		})
+	}
+
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadFS(w, r, fsys, "missing.txt", "missing.txt", nil)
+	})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d for a missing file, want 404", rec.Code)
+	}
+}
+
+// unseekableFS is a file system whose files do not implement io.Seeker.
+type unseekableFS struct {
+	fs.FS
+}
+
+func (u unseekableFS) Open(name string) (fs.File, error) {
+	f, err := u.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{f}, nil
+}
+
+func TestInlineCSP(t *testing.T) {
+	path := writeFile(t, "a.txt", "hello")
+	for _, tt := range []struct {
+		inlineTypes []string
+		want        string
+	}{
+		{nil, SandboxPolicy},
+		{[]string{"image/png"}, ""},
+	} {
+		rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+			ServeDownload(w, r, path, "a.txt", tt.inlineTypes, Infer, WithInlineCSP(SandboxPolicy))
+		})
+		if got := rec.Header().Get("Content-Security-Policy"); got != tt.want {
+			t.Errorf("inline types %v: Content-Security-Policy = %q, want %q", tt.inlineTypes, got, tt.want)
+		}
+	}
+}
+
+func TestServeReader(t *testing.T) {
+	modtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	binary := "\x00\x01\x02\x03"
+
+	tests := []struct {
+		name    string
+		content string
+		infer   func(string) string
+		want    string
+	}{
+		{"Detected", pngHeader, InferByExtension, "image/png"},
+		{"Inferred", binary, InferByExtension, "application/pdf"},
+		{"Undetected", binary, nil, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveRequest(withHeader("/", "Range", "bytes=1-2"), func(w http.ResponseWriter, r *http.Request) {
+				ServeReader(w, r, "file.pdf", modtime, strings.NewReader(tt.content), nil, tt.infer)
+			})
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+			if rec.Code != http.StatusPartialContent || rec.Body.String() != tt.content[1:3] {
+				t.Errorf("response = %d %q, want 206 %q", rec.Code, rec.Body.String(), tt.content[1:3])
+			}
+		})
+	}
+}
+
+func TestContentDispositionRoundTrip(t *testing.T) {
+	tests := []struct {
+		d    Disposition
+		name string
+	}{
+		{Attachment, "report.pdf"},
+		{Inline, "my report (final).pdf"},
+		{Attachment, "résumé.pdf"},
+		{FormData, "a\"b.txt"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		SetDisposition(rec, tt.d, tt.name)
+		header := rec.Header().Get("Content-Disposition")
+
+		d, name, err := ParseContentDisposition(header)
+		if err != nil || d != tt.d || name != tt.name {
+			t.Errorf("ParseContentDisposition(%q) = %q, %q, %v, want %q, %q", header, d, name, err, tt.d, tt.name)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	SetAttachment(rec, "résumé.pdf")
+	if got, want := rec.Header().Get("Content-Disposition"), "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf"; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+
+	if d, _, err := ParseContentDisposition("INLINE"); err != nil || d != Inline {
+		t.Errorf("ParseContentDisposition = %q, %v, want %q", d, err, Inline)
+	}
+	if _, _, err := ParseContentDisposition("attachment; filename"); err == nil {
+		t.Error("malformed header parsed")
+	}
+}
+
+func TestServeMultipart(t *testing.T) {
+	a := writeFile(t, "a.txt", "hello")
+	b := writeFile(t, "b.bin", "\x00\x01")
+	parts := []FilePart{{Path: a, Name: "a.txt"}, {Path: b, Name: "b.bin", ContentType: "application/x-custom"}}
+
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeMultipart(w, r, parts)
+	})
+	mt, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mt != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, %v", rec.Header().Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	want := []struct{ ct, name, body string }{
+		{"text/plain; charset=utf-8", "a.txt", "hello"},
+		{"application/x-custom", "b.bin", "\x00\x01"},
+	}
+	for _, w := range want {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Type") != w.ct || p.FileName() != w.name || string(body) != w.body {
+			t.Errorf("part = %q %q %q, want %q %q %q", p.Header.Get("Content-Type"), p.FileName(), body, w.ct, w.name, w.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("NextPart error = %v after the last part, want EOF", err)
+	}
+
+	rec = serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeMultipart(w, r, append(parts, FilePart{Path: a + ".missing", Name: "c"}))
+	})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d with a missing file, want 404", rec.Code)
+	}
+
+	page := writeFile(t, "page.html", "<html></html>")
+	rec = serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeMultipart(w, r, []FilePart{{Path: page, Name: "page.html"}}, WithDisposition(Inline), WithAlwaysAttachment(ScriptableTypes...))
+	})
+	_, params, _ = mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	p, err := multipart.NewReader(rec.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cd := p.Header.Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") {
+		t.Errorf("Content-Disposition of a scriptable part = %q, want an attachment", cd)
+	}
+}
+
+func TestAcceptRanges(t *testing.T) {
+	path := writeFile(t, "big.txt", compressible)
+
+	tests := map[string]func(http.ResponseWriter, *http.Request){
+		"Download": func(w http.ResponseWriter, r *http.Request) {
+			ServeDownload(w, r, path, "big.txt", nil, Infer)
+		},
+		"Compressed": func(w http.ResponseWriter, r *http.Request) {
+			ServeDownloadCompressed(w, r, path, "big.txt", nil, Infer)
+		},
+		"Generated": func(w http.ResponseWriter, r *http.Request) {
+			ServeGenerated(w, r, "a.txt", "", func(io.Writer) error { return nil })
+		},
+		"Multipart": func(w http.ResponseWriter, r *http.Request) {
+			ServeMultipart(w, r, []FilePart{{Path: path, Name: "big.txt"}})
+		},
+	}
+	want := map[string]string{"Download": "bytes", "Compressed": "none", "Generated": "none", "Multipart": "none"}
+	for name, f := range tests {
+		rec := serveRequest(withHeader("/", "Accept-Encoding", "gzip"), f)
+		if got := rec.Header().Get("Accept-Ranges"); got != want[name] {
+			t.Errorf("%s: Accept-Ranges = %q, want %q", name, got, want[name])
+		}
+	}
+}
+
+func TestHTMLSandbox(t *testing.T) {
+	html := writeFile(t, "mail.html", "<html><body>hello</body></html>")
+	text := writeFile(t, "a.txt", "hello")
+
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeInline(w, r, html, "mail.html", Infer, WithHTMLSandbox(), WithInlineCSP("img-src *"))
+	})
+	if got := rec.Header().Values("Content-Security-Policy"); !slices.Equal(got, []string{"img-src *", "sandbox"}) {
+		t.Errorf("Content-Security-Policy = %q", got)
+	}
+	if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q", got)
+	}
+
+	rec = serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeInline(w, r, text, "a.txt", Infer, WithHTMLSandbox())
+	})
+	if got := rec.Header().Get("Content-Security-Policy"); got != "" {
+		t.Errorf("Content-Security-Policy = %q for a text file", got)
+	}
+}
+
+func TestDownloadTemplate(t *testing.T) {
+	path := writeFile(t, "invoice.pdf", "%PDF-1.4")
+	tmpl := template.Must(template.New("name").Parse("invoice-{{.}}.pdf"))
+
+	name, err := RenderName(tmpl, "../42\r\nX-Evil: 1")
+	if err != nil || name != "invoice-..42X-Evil: 1.pdf" {
+		t.Errorf("RenderName = %q, %v", name, err)
+	}
+	if _, err := RenderName(template.Must(template.New("name").Parse("{{.}}")), " \n"); err == nil {
+		t.Error("RenderName accepted an empty name")
+	}
+
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadTemplate(w, r, path, tmpl, 42, []string{"image/png"}, Infer)
+	})
+	if got := rec.Header().Get("Content-Disposition"); got != "attachment; filename=invoice-42.pdf" {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	rec = serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeDownloadTemplate(w, r, path, template.Must(template.New("name").Parse("{{.Missing}}")), 42, nil, Infer)
+	})
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d for a failing template, want 500", rec.Code)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	timeout := &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, context.DeadlineExceeded
+	})}
+
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeRemote(w, r, timeout, "http://upstream/a.txt", "a.txt", nil, WithRetryAfter(1500*time.Millisecond, nil))
+	})
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("response = %d with Retry-After %q, want 503 with 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	rec = serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeRemote(w, r, timeout, "http://upstream/a.txt", "a.txt", nil)
+	})
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d without WithRetryAfter, want 502", rec.Code)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	rec = serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeRemote(w, r, upstream.Client(), upstream.URL, "a.txt", nil, WithRetryAfter(time.Second, nil))
+	})
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("response = %d with Retry-After %q, want 503 with 30", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	if IsTransient(errors.New("permanent")) || !IsTransient(fmt.Errorf("read: %w", os.ErrDeadlineExceeded)) {
+		t.Error("IsTransient misclassifies errors")
+	}
+}
+
+// roundTripFunc adapts a function to an http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestMinCompressSize(t *testing.T) {
+	small := writeFile(t, "small.txt", "hello")
+
+	for _, tt := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, ""},
+		{[]Option{WithMinCompressSize(0)}, "gzip"},
+	} {
+		rec := serveRequest(withHeader("/", "Accept-Encoding", "gzip"), func(w http.ResponseWriter, r *http.Request) {
+			ServeDownloadCompressed(w, r, small, "small.txt", nil, Infer, tt.opts...)
+		})
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Content-Encoding = %q, want %q", got, tt.want)
+		}
+		if !slices.Contains(rec.Header().Values("Vary"), "Accept-Encoding") {
+			t.Error("Vary does not include Accept-Encoding")
+		}
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	path := writeFile(t, "a.txt", "bonjour")
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeDownload(w, r, path, "a.txt", nil, Infer, WithContentLanguage("fr-CA", "fr"))
+	})
+	if got := rec.Header().Get("Content-Language"); got != "fr-CA, fr" {
+		t.Errorf("Content-Language = %q", got)
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	secret := []byte("secret")
+	signed := SignURL("https://example.com/", "files/a b.txt", time.Now().Add(time.Hour), secret)
+	if !strings.HasPrefix(signed, "https://example.com/files/a%20b.txt?") {
+		t.Fatalf("SignURL = %q", signed)
+	}
+
+	path, err := VerifyURL(httptest.NewRequest(http.MethodGet, signed, nil), secret)
+	if err != nil || path != "/files/a b.txt" {
+		t.Errorf("VerifyURL = %q, %v", path, err)
+	}
+
+	tests := map[string]error{
+		strings.Replace(signed, "a%20b", "c", 1):                                               ErrInvalidSignature,
+		strings.Replace(signed, "expires=", "expires=1", 1):                                    ErrInvalidSignature,
+		"https://example.com/files/a%20b.txt":                                                  ErrInvalidSignature,
+		SignURL("https://example.com", "/files/a b.txt", time.Now().Add(-time.Second), secret): ErrExpiredURL,
+	}
+	for target, want := range tests {
+		if _, err := VerifyURL(httptest.NewRequest(http.MethodGet, target, nil), secret); !errors.Is(err, want) {
+			t.Errorf("VerifyURL(%s) error = %v, want %v", target, err, want)
+		}
+	}
+	if _, err := VerifyURL(httptest.NewRequest(http.MethodGet, signed, nil), []byte("other")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifyURL error = %v with another secret, want %v", err, ErrInvalidSignature)
+	}
+
+	h := RequireSignedURL(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	if rec := serve(t, signed, h.ServeHTTP); rec.Code != http.StatusNoContent {
+		t.Errorf("status = %d for a signed URL, want 204", rec.Code)
+	}
+	if rec := serve(t, "/files/a%20b.txt", h.ServeHTTP); rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d for an unsigned URL, want 403", rec.Code)
+	}
+}
+
+func TestServeForceDownload(t *testing.T) {
+	path := writeFile(t, "page.html", "<html><body>hello</body></html>")
+	rec := serve(t, "/", func(w http.ResponseWriter, r *http.Request) {
+		ServeForceDownload(w, r, path, "page.html", WithDisposition(Inline))
+	})
+
+	want := map[string]string{
+		"Content-Type":           "application/octet-stream",
+		"X-Content-Type-Options": "nosniff",
+		"Content-Disposition":    "attachment; filename=page.html",
+	}
+	for k, v := range want {
+		if got := rec.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if rec.Body.String() != "<html><body>hello</body></html>" {
+		t.Errorf("body = %q", rec.Body.String())
+	}
+}
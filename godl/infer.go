@@ -0,0 +1,291 @@
+package godl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// sniffLen is the number of leading bytes inspected when detecting the MIME
+// type of content that is read from a reader.
+const sniffLen = 3072
+
+// Infer returns the MIME type of the file specified by the given path. It
+// first attempts to determine the MIME type using InferByMagic, and if
+// unsuccessful, it falls back to InferByExtension.
+func Infer(path string) string {
+	m := InferByMagic(path)
+	if m == "" {
+		return InferByExtension(path)
+	}
+	return m
+}
+
+// Sniffer detects the MIME type of content from its leading bytes.
+type Sniffer interface {
+	// Sniff returns the MIME type of the file specified by the given path.
+	Sniff(path string) (string, error)
+	// SniffReader returns the MIME type of the content read from the given
+	// reader, consuming the bytes it inspects.
+	SniffReader(r io.Reader) (string, error)
+}
+
+// MimetypeSniffer is a Sniffer backed by the mimetype module, as used by
+// InferByMagic.
+type MimetypeSniffer struct{}
+
+// Sniff returns the MIME type of the file specified by the given path.
+func (MimetypeSniffer) Sniff(path string) (string, error) {
+	m, err := mimetype.DetectFile(path)
+	if err != nil {
+		return "", err
+	}
+	return m.String(), nil
+}
+
+// SniffReader returns the MIME type of the content read from the given
+// reader.
+func (MimetypeSniffer) SniffReader(r io.Reader) (string, error) {
+	m, err := mimetype.DetectReader(r)
+	if err != nil {
+		return "", err
+	}
+	return m.String(), nil
+}
+
+// StdlibSniffer is a Sniffer backed by http.DetectContentType, which
+// recognizes fewer types than the mimetype module but has no dependencies.
+type StdlibSniffer struct{}
+
+// Sniff returns the MIME type of the file specified by the given path.
+func (s StdlibSniffer) Sniff(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return s.SniffReader(f)
+}
+
+// SniffReader returns the MIME type of the content read from the given
+// reader.
+func (StdlibSniffer) SniffReader(r io.Reader) (string, error) {
+	// http.DetectContentType considers at most 512 bytes.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// InferWith returns an infer function for use with the serve functions that
+// works like Infer, but detects the MIME type using the given Sniffer instead
+// of InferByMagic.
+func InferWith(s Sniffer) func(string) string {
+	return func(path string) string {
+		if m, err := s.Sniff(path); err == nil && m != "" {
+			return m
+		}
+		return InferByExtension(path)
+	}
+}
+
+// InferMethod identifies how a MIME type was inferred.
+type InferMethod int
+
+const (
+	// ByMagic indicates that the MIME type was detected from the content.
+	ByMagic InferMethod = iota
+	// ByExtension indicates that the MIME type was looked up by extension.
+	ByExtension
+)
+
+// InferResult describes the outcome of inferring the MIME type of a file.
+type InferResult struct {
+	// Type is the inferred MIME type.
+	Type string
+	// Method is the method by which Type was inferred.
+	Method InferMethod
+	// Agree reports whether the MIME types inferred from the content and
+	// from the extension are known and match. A mismatch may indicate a
+	// file with a misleading extension.
+	Agree bool
+}
+
+// InferDetailed infers the MIME type of the file specified by the given path
+// like Infer, but also reports how it was inferred and whether detection by
+// content and by extension agree. An error is returned if the file cannot be
+// read and its extension is unknown.
+func InferDetailed(path string) (InferResult, error) {
+	ext := InferByExtension(path)
+
+	m, err := mimetype.DetectFile(path)
+	if err != nil {
+		if ext == "" {
+			return InferResult{}, err
+		}
+		return InferResult{Type: ext, Method: ByExtension}, nil
+	}
+
+	return InferResult{
+		Type:   m.String(),
+		Method: ByMagic,
+		Agree:  ext != "" && m.Is(ext),
+	}, nil
+}
+
+// InferByExtension returns the MIME type of the file specified by the given
+// path using the file extension, or an empty string if no match is found.
+func InferByExtension(path string) string {
+	return mime.TypeByExtension(filepath.Ext(path))
+}
+
+// InferName returns the MIME type for the given file name using its
+// extension, or application/octet-stream if no match is found. Unlike Infer,
+// it never accesses the named file, which need not exist, so it can be used to
+// validate configuration or to route requests by name. The extension is
+// looked up in the table of the mime package, which loads the system's MIME
+// type files once when it is first used.
+func InferName(name string) string {
+	if m := mime.TypeByExtension(filepath.Ext(name)); m != "" {
+		return m
+	}
+	return "application/octet-stream"
+}
+
+// InferByMagic returns the MIME type of the file specified by the given
+// path using the mimetype module, or an empty string if no match is found.
+func InferByMagic(path string) string {
+	if m, err := mimetype.DetectFile(path); err == nil {
+		return m.String()
+	}
+	return ""
+}
+
+// InferByMagicReader returns the MIME type of the content read from the given
+// reader using the mimetype module, reading at most limit bytes, or as many
+// bytes as mimetype inspects if limit is not positive. This bounds the work
+// spent on untrusted content. If the context is done before the bytes have
+// been read, for example because a network-backed reader is stalled,
+// application/octet-stream is returned; the read continues in the background
+// until the reader returns, so such readers should be closed by the caller.
+// The bytes read are consumed from the reader.
+func InferByMagicReader(ctx context.Context, r io.Reader, limit int) string {
+	if limit <= 0 {
+		limit = sniffLen
+	}
+
+	heads := make(chan []byte, 1)
+	go func() {
+		head := make([]byte, limit)
+		n, _ := io.ReadFull(r, head)
+		heads <- head[:n]
+	}()
+
+	select {
+	case head := <-heads:
+		return mimetype.Detect(head).String()
+	case <-ctx.Done():
+		return "application/octet-stream"
+	}
+}
+
+// NameWithExtension returns the given file name with an extension for the
+// given MIME type appended, if the name has no extension yet and ExtensionFor
+// knows an extension for the type. For example, "report" with the type
+// application/pdf becomes "report.pdf". Otherwise the name is returned
+// unchanged.
+func NameWithExtension(name string, mimeType string) string {
+	if filepath.Ext(name) != "" {
+		return name
+	}
+	if ext, ok := ExtensionFor(mimeType); ok {
+		return name + ext
+	}
+	return name
+}
+
+// preferredExtensions maps MIME types with several registered extensions to
+// the extension most commonly used for them.
+var preferredExtensions = map[string]string{
+	"application/gzip":       ".gz",
+	"application/javascript": ".js",
+	"application/xml":        ".xml",
+	"audio/mp4":              ".m4a",
+	"audio/mpeg":             ".mp3",
+	"audio/ogg":              ".ogg",
+	"image/jpeg":             ".jpg",
+	"image/svg+xml":          ".svg",
+	"image/tiff":             ".tiff",
+	"text/html":              ".html",
+	"text/javascript":        ".js",
+	"text/markdown":          ".md",
+	"text/plain":             ".txt",
+	"video/mp4":              ".mp4",
+	"video/mpeg":             ".mpeg",
+	"video/quicktime":        ".mov",
+}
+
+// ExtensionFor returns the preferred file extension for the given MIME type,
+// including the leading dot, and whether one is known. Parameters of the type
+// are ignored. A curated preference is used for common types with several
+// registered extensions, such as .jpg rather than .jpe for image/jpeg;
+// otherwise the extension known to the mimetype module is used, falling back
+// to the first extension returned by mime.ExtensionsByType.
+func ExtensionFor(mimeType string) (string, bool) {
+	mt, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "", false
+	}
+
+	if ext, ok := preferredExtensions[mt]; ok {
+		return ext, true
+	}
+	if m := mimetype.Lookup(mt); m != nil && m.Extension() != "" {
+		return m.Extension(), true
+	}
+	if exts, err := mime.ExtensionsByType(mt); err == nil && len(exts) > 0 {
+		return exts[0], true
+	}
+	return "", false
+}
+
+// SetContentType sets the Content-Type header for the file specified by the
+// given path, inferred using the provided infer function.
+func SetContentType(w http.ResponseWriter, path string, infer func(string) string) {
+	m := infer(path)
+	if m == "" {
+		m = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", m)
+}
+
+// SetContentTypeFromReader sets the Content-Type header to the MIME type
+// detected from the leading bytes read from r, falling back to
+// application/octet-stream. Since detection consumes these bytes, it returns
+// a reader that yields them again, followed by the rest of r.
+func SetContentTypeFromReader(w http.ResponseWriter, r io.Reader) (io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	head = head[:n]
+
+	m := mimetype.Detect(head).String()
+	if m == "" {
+		m = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", m)
+
+	return io.MultiReader(bytes.NewReader(head), r), nil
+}
@@ -0,0 +1,149 @@
+package godl
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// hashingWriter is a response writer that hashes the body written to it.
+type hashingWriter struct {
+	http.ResponseWriter
+	h hash.Hash
+	n int64
+}
+
+// Write writes p to the response and hashes the bytes written.
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.ResponseWriter.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped response writer for use by
+// http.ResponseController.
+func (hw *hashingWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// wrap returns the response writer that serve functions write to, along
+// with a function to call once the response has been served. The writer is
+// wrapped if the options are configured WithSentHash.
+func (o options) wrap(w http.ResponseWriter) (http.ResponseWriter, func()) {
+	if o.sentHash == nil {
+		return w, func() {}
+	}
+
+	hw := &hashingWriter{ResponseWriter: w, h: sha256.New()}
+	return hw, func() { o.sentHash(hw.h.Sum(nil), hw.n) }
+}
+
+// bufferPools holds a pool of buffers for each size configured
+// WithBufferSize.
+var bufferPools sync.Map
+
+// copy copies from src to dst as done by copyContext, using a pooled buffer
+// of the size configured WithBufferSize, if any.
+func (o options) copy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	if o.bufferSize <= 0 {
+		return copyContext(ctx, dst, src)
+	}
+
+	pool := bufferPool(o.bufferSize)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+
+	// Hiding io.ReaderFrom keeps the destination from using its own buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, contextReader{ctx: ctx, r: src}, *buf)
+}
+
+// bufferPool returns the pool of buffers of the given size, creating it only
+// if it does not exist yet.
+func bufferPool(size int) *sync.Pool {
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() any {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// ErrMaxBytesExceeded is returned by writes to the writer passed to the
+// generate function of ServeGenerated once the limit configured WithMaxBytes
+// has been reached.
+var ErrMaxBytesExceeded = errors.New("godl: response exceeds maximum size")
+
+// limit returns src limited to the number of bytes configured WithMaxBytes,
+// if any.
+func (o options) limit(src io.Reader) io.Reader {
+	if o.maxBytes <= 0 {
+		return src
+	}
+	return &maxBytesReader{r: src, n: o.maxBytes}
+}
+
+// maxBytesReader is a reader that fails with ErrMaxBytesExceeded once more
+// than n bytes are available from the underlying reader.
+type maxBytesReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads up to the remaining number of bytes from the underlying reader.
+// Once none remain, it probes for another byte to distinguish the end of the
+// content from an overrun.
+func (mr *maxBytesReader) Read(p []byte) (int, error) {
+	if mr.n <= 0 {
+		var probe [1]byte
+		n, err := mr.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrMaxBytesExceeded
+		}
+		return 0, err
+	}
+	if int64(len(p)) > mr.n {
+		p = p[:mr.n]
+	}
+	n, err := mr.r.Read(p)
+	mr.n -= int64(n)
+	return n, err
+}
+
+// overrun logs that the response to the request was ended because it
+// exceeded the limit configured WithMaxBytes, if err indicates so.
+func (o options) overrun(r *http.Request, err error) {
+	if o.logger == nil || !errors.Is(err, ErrMaxBytesExceeded) {
+		return
+	}
+	o.logger.Warn("response exceeds maximum size", "path", r.URL.Path, "limit", o.maxBytes)
+}
+
+// contextReader is a reader that fails once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read reads from the underlying reader unless the context is done, in which
+// case it returns the context's error.
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// copyContext copies from src to dst like io.Copy, but stops as soon as the
+// context is done, such as when the client of a request disconnects.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, contextReader{ctx: ctx, r: src})
+}
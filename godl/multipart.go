@@ -0,0 +1,126 @@
+package godl
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+)
+
+// FilePart describes a file served as a part of a multipart response by
+// ServeMultipart.
+type FilePart struct {
+	// Path is the path of the file.
+	Path string
+	// Name is the file name given in the Content-Disposition header of the
+	// part.
+	Name string
+	// ContentType is the Content-Type of the part. If it is empty, it is
+	// inferred from the file by Infer.
+	ContentType string
+}
+
+// ServeMultipart serves the given files as a multipart/mixed response with
+// one part per file, for clients that parse multipart bodies natively rather
+// than archives. Each part has its own Content-Type header and a
+// Content-Disposition header of type Attachment, or of the type configured
+// WithDisposition, with the name of the file. The boundary is given in the
+// Content-Type header of the response.
+//
+// All files are checked before the response is written, so that a missing
+// file results in 404 Not Found. If a file cannot be read once the response
+// has been started, the response is cut short without a closing boundary, so
+// that clients can tell it is incomplete. Range and conditional requests are
+// not supported, as indicated by an Accept-Ranges header of "none".
+func ServeMultipart(w http.ResponseWriter, r *http.Request, parts []FilePart, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+
+	for _, part := range parts {
+		fi, err := os.Stat(part.Path)
+		if err != nil {
+			o.serveError(w, err)
+			return
+		}
+		if fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	o.apply(w, r, "", "")
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	d := Attachment
+	if o.disposition != "" {
+		d = o.disposition
+	}
+
+	// The limit configured WithMaxBytes applies to all parts together.
+	var lim *maxBytesReader
+	if o.maxBytes > 0 {
+		lim = &maxBytesReader{n: o.maxBytes}
+	}
+
+	for _, part := range parts {
+		if err := o.writePart(r.Context(), mw, part, d, lim); err != nil {
+			o.overrun(r, err)
+			return
+		}
+	}
+	_ = mw.Close()
+}
+
+// writePart writes the file described by the given part as a part of the
+// multipart writer, reading it through lim unless it is nil.
+func (o options) writePart(ctx context.Context, mw *multipart.Writer, part FilePart, d Disposition, lim *maxBytesReader) error {
+	f, err := os.Open(part.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ct := part.ContentType
+	if ct == "" {
+		ct = Infer(part.Path)
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+
+	if o.forcedAttachment(ct) {
+		d = Attachment
+	}
+	params := map[string]string{"filename": part.Name}
+	if d == FormData {
+		params["name"] = o.fieldName
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", ct)
+	h.Set("Content-Disposition", mime.FormatMediaType(string(d), params))
+
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	var src io.Reader = f
+	if lim != nil {
+		lim.r = f
+		src = lim
+	}
+	_, err = o.copy(ctx, pw, src)
+	return err
+}
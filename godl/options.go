@@ -0,0 +1,363 @@
+package godl
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Option configures optional behavior of the serve functions.
+type Option func(*options)
+
+// options holds the optional configuration of the serve functions.
+type options struct {
+	encodings        []Encoding
+	etag             bool
+	etagMode         ETagMode
+	alwaysAttachment []string
+	disposition      Disposition
+	fieldName        string
+	addExtension     bool
+	immutableNames   *regexp.Regexp
+	cacheControl     string
+	contentMD5       bool
+	reprDigest       bool
+	explicitInline   bool
+	dispositionFunc  func(*http.Request) Disposition
+	preload          []string
+	sentHash         func(sum []byte, n int64)
+	bufferSize       int
+	maxBytes         int64
+	seekBuffer       int64
+	inlineCSP        string
+	htmlSandbox      bool
+	retryAfter       time.Duration
+	minCompressSize  int64
+	contentLanguage  string
+	transient        func(error) bool
+	logger           *slog.Logger
+}
+
+// newOptions returns the default options with the given options applied.
+func newOptions(opts []Option) options {
+	o := options{
+		encodings:       []Encoding{Gzip, Deflate},
+		fieldName:       "file",
+		seekBuffer:      1 << 20,
+		minCompressSize: 1024,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithEncodings configures the content codings that compressing serve
+// functions may apply, in order of preference. The default is Gzip followed
+// by Deflate. Brotli is not available by default, but can be supported by
+// passing an Encoding named "br" backed by a brotli encoder.
+func WithEncodings(encodings ...Encoding) Option {
+	return func(o *options) {
+		o.encodings = encodings
+	}
+}
+
+// WithMinCompressSize configures the size below which compressing serve
+// functions serve files uncompressed, since compressing small files costs more
+// than it saves and can even increase their size. The default is 1 KiB; a
+// size of zero compresses all files.
+func WithMinCompressSize(n int64) Option {
+	return func(o *options) {
+		o.minCompressSize = n
+	}
+}
+
+// WithETag makes the serve functions set an ETag header computed with the
+// given mode. Conditional requests using If-None-Match and If-Match are then
+// evaluated against it, following the weak and strong comparison rules of RFC
+// 7232. Use Strong if clients resume downloads with If-Range, as described
+// for ETag.
+func WithETag(mode ETagMode) Option {
+	return func(o *options) {
+		o.etag = true
+		o.etagMode = mode
+	}
+}
+
+// WithContentMD5 makes the serve functions set a Content-MD5 header, as
+// computed by ContentMD5, for legacy clients that verify downloads with it.
+// The header always covers the complete file, so it is omitted from
+// compressed responses but not from responses to range requests. MD5 is not
+// collision resistant and must not be relied upon for integrity against
+// tampering.
+func WithContentMD5() Option {
+	return func(o *options) {
+		o.contentMD5 = true
+	}
+}
+
+// WithReprDigest makes the serve functions set a Repr-Digest header as
+// defined by RFC 9530, computed by ReprDigest with the algorithm most
+// preferred by the Want-Repr-Digest header of the request, or with sha-256 if
+// the request has none. No header is set if the request accepts none of the
+// supported algorithms, sha-256 and sha-512. Like the header set
+// WithContentMD5, it covers the complete file and is omitted from compressed
+// responses.
+func WithReprDigest() Option {
+	return func(o *options) {
+		o.reprDigest = true
+	}
+}
+
+// WithAlwaysAttachment configures MIME types that are always served as
+// attachments, even if they are inline types. This takes precedence over an
+// explicit inline type, an empty list of inline types, and the dispositions
+// chosen by WithDisposition, WithDispositionFunc and functions such as
+// ServeInline. Types are compared without their parameters. ScriptableTypes
+// is a suitable set for serving untrusted files.
+func WithAlwaysAttachment(types ...string) Option {
+	return func(o *options) {
+		o.alwaysAttachment = append(o.alwaysAttachment, types...)
+	}
+}
+
+// WithDisposition makes the serve functions set a Content-Disposition header
+// of the given type, instead of the one they would set otherwise.
+func WithDisposition(d Disposition) Option {
+	return func(o *options) {
+		o.disposition = d
+	}
+}
+
+// WithDispositionFunc makes the serve functions call f with the request to
+// determine the type of the Content-Disposition header, for example to serve
+// attachments to clients whose User-Agent indicates that they cannot display
+// certain types inline. If f returns an empty type, the header is set as if
+// the option was not used.
+func WithDispositionFunc(f func(*http.Request) Disposition) Option {
+	return func(o *options) {
+		o.dispositionFunc = f
+	}
+}
+
+// WithPreload makes the serve functions add a Link header with the preload
+// relation for each of the given targets, such as "/style.css", so that
+// clients can fetch related resources early. The as attribute is derived from
+// the extension of each target for stylesheets, scripts, fonts and images,
+// and fonts are marked crossorigin as required for them to be used.
+func WithPreload(targets ...string) Option {
+	return func(o *options) {
+		o.preload = append(o.preload, targets...)
+	}
+}
+
+// preloadLink returns the value of a Link header preloading the given
+// target.
+func preloadLink(target string) string {
+	link := "<" + target + ">; rel=preload"
+
+	ext := filepath.Ext(target)
+	if i := strings.IndexAny(ext, "?#"); i >= 0 {
+		ext = ext[:i]
+	}
+	mt, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	switch {
+	case mt == "text/css":
+		link += "; as=style"
+	case mt == "text/javascript" || mt == "application/javascript":
+		link += "; as=script"
+	case strings.HasPrefix(mt, "font/"):
+		link += "; as=font; crossorigin"
+	case strings.HasPrefix(mt, "image/"):
+		link += "; as=image"
+	}
+	return link
+}
+
+// WithSentHash makes the serve functions call f with the SHA-256 hash and
+// the number of bytes of the response body actually written to the client,
+// once the response has been served. Unlike a checksum computed in advance,
+// this reflects exactly what was transmitted: compressed bytes for compressed
+// responses, only the requested ranges for range requests, and a truncated
+// body if the client went away. Responses without a body, such as 304 Not
+// Modified, report the hash of no bytes. Since the response writer is wrapped,
+// files are not sent using sendfile.
+func WithSentHash(f func(sum []byte, n int64)) Option {
+	return func(o *options) {
+		o.sentHash = f
+	}
+}
+
+// WithBufferSize configures the size of the buffer used to copy content to
+// the response by the serve functions that stream it themselves, such as
+// ServeDownloadCompressed and ServeRemote, which otherwise copy using the
+// buffers of the io package and net/http. Larger buffers can increase the
+// throughput of large files. Buffers are pooled per size, so they are not
+// allocated for every request.
+func WithBufferSize(n int) Option {
+	return func(o *options) {
+		o.bufferSize = n
+	}
+}
+
+// WithMaxBytes limits the content streamed by the serve functions that copy it
+// themselves, such as ServeDownloadCompressed, ServeRange, ServeRemote and
+// ServeGenerated, to n bytes, so that responses stay bounded even if a file
+// grows while it is served or a remote or generated source produces more than
+// expected. Once the limit is exceeded, the response is ended after the first
+// n bytes and the overrun is logged to the logger configured WithLogger. For
+// compressed responses, the limit applies to the content before encoding.
+func WithMaxBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBytes = n
+	}
+}
+
+// WithLogger configures a logger to which the serve functions emit
+// structured records about responses that had to be aborted, such as those
+// exceeding the limit configured WithMaxBytes. By default, nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithSeekBuffer configures the size up to which ServeDownloadFS buffers
+// files that do not implement io.Seeker in memory, so that range requests can
+// be served for them. Larger files are streamed without range support. The
+// default is 1 MiB; a size of zero disables buffering.
+func WithSeekBuffer(n int64) Option {
+	return func(o *options) {
+		o.seekBuffer = n
+	}
+}
+
+// WithExplicitInline makes the serve functions set a Content-Disposition
+// header of type Inline for files displayed inline, for which ServeDownload
+// and similar functions set no header by default. Some clients only handle
+// inline files correctly if the header is present.
+func WithExplicitInline() Option {
+	return func(o *options) {
+		o.explicitInline = true
+	}
+}
+
+// WithFieldName configures the field name included in Content-Disposition
+// headers of type FormData, which defaults to "file".
+func WithFieldName(name string) Option {
+	return func(o *options) {
+		o.fieldName = name
+	}
+}
+
+// WithExtension makes the serve functions append an extension matching the
+// Content-Type to file names in Content-Disposition headers that lack one, as
+// done by NameWithExtension.
+func WithExtension() Option {
+	return func(o *options) {
+		o.addExtension = true
+	}
+}
+
+// SandboxPolicy is a Content-Security-Policy that prevents content from
+// loading resources and running scripts, suitable for WithInlineCSP when
+// serving untrusted files such as user-uploaded images.
+const SandboxPolicy = "default-src 'none'; sandbox"
+
+// WithInlineCSP makes the serve functions set the Content-Security-Policy
+// header to the given policy, such as SandboxPolicy, for files displayed
+// inline, which neutralizes scripts embedded in polyglot files as a defense
+// in depth. Attachments are left without the header.
+func WithInlineCSP(policy string) Option {
+	return func(o *options) {
+		o.inlineCSP = policy
+	}
+}
+
+// WithHTMLSandbox makes the serve functions display HTML documents inline
+// inside a sandbox, for previews of untrusted documents such as e-mails. HTML
+// files served inline receive a Content-Security-Policy of "sandbox", which
+// makes the browser treat the document as if it came from a unique origin
+// and blocks scripts, forms and popups, along with an X-Content-Type-Options
+// header of "nosniff". Unlike WithInlineCSP, the document may still load
+// resources such as images and stylesheets. The policy is added to any policy
+// configured WithInlineCSP, in which case both are enforced.
+func WithHTMLSandbox() Option {
+	return func(o *options) {
+		o.htmlSandbox = true
+	}
+}
+
+// ImmutableCacheControl is the Cache-Control header value set for file
+// names matched by the pattern configured WithImmutableNames.
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+// WithImmutableNames makes the serve functions set the Cache-Control header
+// to ImmutableCacheControl when the file name matches the given pattern, such
+// as names containing a content hash produced by an asset pipeline. Other
+// files receive the Cache-Control value configured WithCacheControl, which
+// defaults to "no-cache" when this option is used.
+func WithImmutableNames(pattern *regexp.Regexp) Option {
+	return func(o *options) {
+		o.immutableNames = pattern
+		if o.cacheControl == "" {
+			o.cacheControl = "no-cache"
+		}
+	}
+}
+
+// WithCacheControl makes the serve functions set the Cache-Control header
+// to the given value, unless the file name is matched WithImmutableNames.
+func WithCacheControl(value string) Option {
+	return func(o *options) {
+		o.cacheControl = value
+	}
+}
+
+// WithContentLanguage makes the serve functions set the Content-Language
+// header to the given language tags, such as "fr-CA", to advertise the
+// language of localized documents, for example after selecting the file to
+// serve by the Accept-Language header of the request.
+func WithContentLanguage(tags ...string) Option {
+	return func(o *options) {
+		o.contentLanguage = strings.Join(tags, ", ")
+	}
+}
+
+// apply sets the headers configured by the options for the file specified by
+// the given path and name. An empty path denotes content that is not a local
+// file, for which headers derived from the file are not set.
+func (o options) apply(w http.ResponseWriter, r *http.Request, path string, name string) {
+	if o.etag && path != "" {
+		_ = SetETag(w, path, o.etagMode)
+	}
+	for _, target := range o.preload {
+		w.Header().Add("Link", preloadLink(target))
+	}
+	if o.contentLanguage != "" {
+		w.Header().Set("Content-Language", o.contentLanguage)
+	}
+	if o.contentMD5 && path != "" {
+		if sum, err := ContentMD5(path); err == nil {
+			w.Header().Set("Content-MD5", sum)
+		}
+	}
+	if o.reprDigest && path != "" {
+		w.Header().Add("Vary", "Want-Repr-Digest")
+		if alg, ok := negotiateDigest(r.Header.Get("Want-Repr-Digest")); ok {
+			if digest, err := ReprDigest(path, alg); err == nil {
+				w.Header().Set("Repr-Digest", digest)
+			}
+		}
+	}
+
+	if o.immutableNames != nil && o.immutableNames.MatchString(name) {
+		w.Header().Set("Cache-Control", ImmutableCacheControl)
+	} else if o.cacheControl != "" {
+		w.Header().Set("Cache-Control", o.cacheControl)
+	}
+}
@@ -0,0 +1,107 @@
+package godl
+
+import "net/http"
+
+// remoteHeaders lists the upstream response headers that ServeRemote
+// relays to the client.
+var remoteHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"Accept-Ranges",
+	"Last-Modified",
+	"ETag",
+}
+
+// ServeRemote serves the content at the given remote URL by proxying it from an
+// upstream server using the given client, or http.DefaultClient if it is nil.
+// The Content-Type reported by the upstream server determines whether the
+// content is shown inline based on the list of inline types, like
+// ServeDownload, and the Content-Disposition header is set accordingly using
+// the specified name.
+//
+// The client's Range and If-Range headers are passed on to the upstream
+// server, and a partial 206 response is relayed along with its Content-Range
+// header, so that resumable downloads work through the proxy. If the upstream
+// server ignores the range, its full 200 response is relayed instead. The
+// Accept-Ranges header of the upstream server is relayed, or set to "none" if
+// the upstream server sends none. An upstream 404 is relayed as such, while
+// other failures result in 502 Bad Gateway.
+func ServeRemote(w http.ResponseWriter, r *http.Request, client *http.Client, remoteURL string, name string, inlineTypes []string, opts ...Option) {
+	o := newOptions(opts)
+	w, sent := o.wrap(w)
+	defer sent()
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), method, remoteURL, nil)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, h := range []string{"Range", "If-Range"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if !o.unavailable(w, err) {
+			http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusNotFound:
+		http.NotFound(w, r)
+		return
+	case http.StatusServiceUnavailable:
+		if o.retryAfter <= 0 {
+			http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		if v := resp.Header.Get("Retry-After"); v != "" {
+			w.Header().Set("Retry-After", v)
+		} else {
+			w.Header().Set("Retry-After", o.retryAfterHeader())
+		}
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	o.apply(w, r, "", name)
+	for _, h := range remoteHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if w.Header().Get("Accept-Ranges") == "" {
+		w.Header().Set("Accept-Ranges", "none")
+	}
+
+	o.setDisposition(w, r, o.downloadDisposition(w, inlineTypes), name)
+
+	w.WriteHeader(resp.StatusCode)
+
+	if r.Method != http.MethodHead {
+		_, err = o.copy(r.Context(), w, o.limit(resp.Body))
+		o.overrun(r, err)
+	}
+}
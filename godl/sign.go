@@ -0,0 +1,92 @@
+package godl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned by VerifyURL if a URL is not signed or
+	// its signature does not match its path and expiry.
+	ErrInvalidSignature = errors.New("godl: invalid URL signature")
+
+	// ErrExpiredURL is returned by VerifyURL if a URL is correctly signed but
+	// has expired.
+	ErrExpiredURL = errors.New("godl: signed URL has expired")
+)
+
+// SignURL returns a URL for the given path below base, such as
+// "https://example.com/downloads", that is valid until the given time. The
+// URL carries the expiry and an HMAC-SHA256 signature over the path and
+// expiry, keyed with secret, in its expires and signature query parameters,
+// to be checked by VerifyURL or RequireSignedURL. The path is signed
+// unescaped and must be the path under which the request reaches the
+// verifying handler, so if base has a path of its own, that prefix should be
+// removed before verification, such as by http.StripPrefix.
+func SignURL(base string, path string, expires time.Time, secret []byte) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{
+		"expires":   {exp},
+		"signature": {urlSignature(path, exp, secret)},
+	}
+	return strings.TrimSuffix(base, "/") + (&url.URL{Path: path}).EscapedPath() + "?" + q.Encode()
+}
+
+// VerifyURL checks the signature and expiry of a URL returned by SignURL as
+// requested by r, and returns its signed path. It returns ErrInvalidSignature
+// if the URL is not signed, or if its path or expiry has been changed since
+// it was signed, and ErrExpiredURL if it has expired.
+func VerifyURL(r *http.Request, secret []byte) (path string, err error) {
+	q := r.URL.Query()
+	exp, sig := q.Get("expires"), q.Get("signature")
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if exp == "" || err != nil {
+		return "", ErrInvalidSignature
+	}
+	got, _ := base64.RawURLEncoding.DecodeString(urlSignature(r.URL.Path, exp, secret))
+	if !hmac.Equal(got, want) {
+		return "", ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	if !time.Now().Before(time.Unix(unix, 0)) {
+		return "", ErrExpiredURL
+	}
+	return r.URL.Path, nil
+}
+
+// RequireSignedURL returns a handler that passes requests for URLs returned
+// by SignURL on to next, and replies to all others, including those for
+// expired or tampered URLs, with 403 Forbidden. It protects handlers that
+// call the serve functions, which can then serve the file named by the
+// request's URL path.
+func RequireSignedURL(secret []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := VerifyURL(r, secret); err != nil {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// urlSignature returns the encoded signature of a signed URL for the given
+// path and expiry. The expiry consists of digits only and is separated from
+// the path by a colon, so that no two pairs share a signed message.
+func urlSignature(path string, exp string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(exp + ":" + path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
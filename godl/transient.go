@@ -0,0 +1,72 @@
+package godl
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// WithRetryAfter makes the serve functions answer requests that fail because
+// of a transient error, as reported by transient, with 503 Service Unavailable
+// and a Retry-After header asking the client to retry after the given delay,
+// rounded up to whole seconds. This applies to errors of opening and reading
+// files, including those of file systems served by ServeDownloadFS, and to
+// errors of reaching the upstream server of ServeRemote. ServeRemote also
+// relays an upstream 503 as such, with the upstream Retry-After header if it
+// has one, instead of answering with 502 Bad Gateway. If transient is nil,
+// IsTransient is used.
+func WithRetryAfter(delay time.Duration, transient func(error) bool) Option {
+	return func(o *options) {
+		o.retryAfter = delay
+		o.transient = transient
+		if o.transient == nil {
+			o.transient = IsTransient
+		}
+	}
+}
+
+// IsTransient reports whether err is likely to be transient, so that
+// retrying the failed operation later may succeed. This is the case for
+// timeouts, refused and reset connections, and resources that are
+// temporarily unavailable or busy. On Plan 9, which has no error numbers,
+// only timeouts are recognized.
+func IsTransient(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		isTransientErrno(err)
+}
+
+// unavailable replies to the request with 503 Service Unavailable and the
+// Retry-After header configured WithRetryAfter if err is transient, and
+// reports whether it did.
+func (o options) unavailable(w http.ResponseWriter, err error) bool {
+	if o.retryAfter <= 0 || !o.transient(err) {
+		return false
+	}
+	w.Header().Set("Retry-After", o.retryAfterHeader())
+	http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+	return true
+}
+
+// retryAfterHeader returns the value of the Retry-After header configured
+// WithRetryAfter.
+func (o options) retryAfterHeader() string {
+	return strconv.Itoa(int(math.Ceil(o.retryAfter.Seconds())))
+}
+
+// serveError replies to the request like the serveError function, unless
+// err is transient and the options are configured WithRetryAfter.
+func (o options) serveError(w http.ResponseWriter, err error) {
+	if !o.unavailable(w, err) {
+		serveError(w, err)
+	}
+}
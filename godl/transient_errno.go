@@ -0,0 +1,18 @@
+//go:build !plan9
+
+package godl
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isTransientErrno reports whether err is a system call error that is likely
+// to be transient, as described for IsTransient.
+func isTransientErrno(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EBUSY)
+}
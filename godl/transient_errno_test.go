@@ -0,0 +1,20 @@
+//go:build !plan9
+
+package godl
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestIsTransientErrno(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.EAGAIN, syscall.EBUSY} {
+		if !IsTransient(fmt.Errorf("read: %w", errno)) {
+			t.Errorf("IsTransient(%v) = false, want true", errno)
+		}
+	}
+	if IsTransient(syscall.ENOENT) {
+		t.Errorf("IsTransient(%v) = true, want false", syscall.ENOENT)
+	}
+}
@@ -0,0 +1,7 @@
+package godl
+
+// isTransientErrno reports false, since Plan 9 reports system call errors as
+// strings rather than error numbers.
+func isTransientErrno(error) bool {
+	return false
+}
@@ -0,0 +1,111 @@
+package upsched
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"time"
+)
+
+// AnyScheduler is a non-generic view of an UploadScheduler, whose methods
+// take keys of any type, so that schedulers with different key types can be
+// kept together, for example in a single map. Keys must have the exact key
+// type of the wrapped UploadScheduler, otherwise ErrKeyType is returned. As for Scheduler,
+// the timeout passed to Prepare is given in seconds.
+type AnyScheduler interface {
+	Prepare(k any, timeout time.Duration, cb func(any, error), opts ...PrepareOption) error
+	Append(k any, chunk multipart.File, dst io.Writer) error
+	AppendFrom(k any, chunk io.Reader, dst io.Writer) error
+	AppendPart(k any, part *multipart.FileHeader, dst io.Writer) error
+	Finish(k any) error
+	Exists(k any) bool
+	Status(k any) (UploadStatus, error)
+	Close() error
+}
+
+// NewAnyScheduler returns an AnyScheduler that delegates to the given
+// UploadScheduler.
+func NewAnyScheduler[K Key](s *UploadScheduler[K]) AnyScheduler {
+	return anyScheduler[K]{s: s}
+}
+
+// anyScheduler implements the AnyScheduler interface.
+type anyScheduler[K Key] struct {
+	s *UploadScheduler[K]
+}
+
+// key asserts that k has the key type of the wrapped scheduler.
+func (as anyScheduler[K]) key(k any) (K, error) {
+	kk, ok := k.(K)
+	if !ok {
+		var zero K
+		return zero, fmt.Errorf("%w: got %T, want %T", ErrKeyType, k, zero)
+	}
+	return kk, nil
+}
+
+// Prepare calls Prepare of the wrapped scheduler.
+func (as anyScheduler[K]) Prepare(k any, timeout time.Duration, cb func(any, error), opts ...PrepareOption) error {
+	kk, err := as.key(k)
+	if err != nil {
+		return err
+	}
+	return as.s.Prepare(kk, timeout, func(k K, err error) { cb(k, err) }, opts...)
+}
+
+// Append calls Append of the wrapped scheduler.
+func (as anyScheduler[K]) Append(k any, chunk multipart.File, dst io.Writer) error {
+	kk, err := as.key(k)
+	if err != nil {
+		return err
+	}
+	return as.s.Append(kk, chunk, dst)
+}
+
+// AppendFrom calls AppendFrom of the wrapped scheduler.
+func (as anyScheduler[K]) AppendFrom(k any, chunk io.Reader, dst io.Writer) error {
+	kk, err := as.key(k)
+	if err != nil {
+		return err
+	}
+	return as.s.AppendFrom(kk, chunk, dst)
+}
+
+// AppendPart calls AppendPart of the wrapped scheduler.
+func (as anyScheduler[K]) AppendPart(k any, part *multipart.FileHeader, dst io.Writer) error {
+	kk, err := as.key(k)
+	if err != nil {
+		return err
+	}
+	return as.s.AppendPart(kk, part, dst)
+}
+
+// Finish calls Finish of the wrapped scheduler.
+func (as anyScheduler[K]) Finish(k any) error {
+	kk, err := as.key(k)
+	if err != nil {
+		return err
+	}
+	return as.s.Finish(kk)
+}
+
+// Exists calls Exists of the wrapped scheduler, reporting false for keys
+// of the wrong type.
+func (as anyScheduler[K]) Exists(k any) bool {
+	kk, err := as.key(k)
+	return err == nil && as.s.Exists(kk)
+}
+
+// Status calls Status of the wrapped scheduler.
+func (as anyScheduler[K]) Status(k any) (UploadStatus, error) {
+	kk, err := as.key(k)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	return as.s.Status(kk)
+}
+
+// Close calls Close of the wrapped scheduler.
+func (as anyScheduler[K]) Close() error {
+	return as.s.Close()
+}
@@ -0,0 +1,678 @@
+package upsched
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/time/rate"
+)
+
+// queueMutex is a mutual exclusion lock that is acquired in the order in
+// which it was requested. The zero value is an unlocked mutex.
+type queueMutex struct {
+	mu      sync.Mutex
+	locked  bool
+	waiters []chan struct{}
+}
+
+// Lock locks the mutex, waiting for all preceding callers of Lock to have
+// acquired and released it.
+func (m *queueMutex) Lock() {
+	m.LockQueued(-1)
+}
+
+// LockQueued locks the mutex like Lock, unless it is locked and limit
+// callers are already waiting for it, in which case it returns false without
+// waiting. A negative limit does not limit the number of waiting callers.
+func (m *queueMutex) LockQueued(limit int) bool {
+	m.mu.Lock()
+	if !m.locked {
+		m.locked = true
+		m.mu.Unlock()
+		return true
+	}
+	if limit >= 0 && len(m.waiters) >= limit {
+		m.mu.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	m.waiters = append(m.waiters, ch)
+	m.mu.Unlock()
+
+	// The mutex is handed over by Unlock without being unlocked.
+	<-ch
+	return true
+}
+
+// TryLock locks the mutex if it is unlocked and reports whether it did.
+func (m *queueMutex) TryLock() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.locked {
+		return false
+	}
+	m.locked = true
+	return true
+}
+
+// Unlock unlocks the mutex, handing it over to the longest waiting caller,
+// if any.
+func (m *queueMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.waiters) == 0 {
+		m.locked = false
+		return
+	}
+	close(m.waiters[0])
+	m.waiters = m.waiters[1:]
+}
+
+// limitedReader is a reader that waits for a rate limiter to allow each
+// read's bytes before returning them.
+type limitedReader struct {
+	r io.Reader
+	l *rate.Limiter
+}
+
+// Read reads at most the limiter's burst size and waits until the limiter
+// allows the bytes read.
+func (lr limitedReader) Read(p []byte) (int, error) {
+	if b := lr.l.Burst(); b > 0 && len(p) > b {
+		p = p[:b]
+	}
+
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.l.WaitN(context.Background(), n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// source returns the reader from which a chunk is copied, subject to the
+// configured rate limiter.
+func (us *UploadScheduler[K]) source(chunk io.Reader) io.Reader {
+	if us.opts.limiter == nil {
+		return chunk
+	}
+	return limitedReader{r: chunk, l: us.opts.limiter}
+}
+
+// copyChunk copies the chunk to the destination, retrying failed copies
+// according to the configured retry policy. If limit is not negative, at most
+// limit bytes are copied, and copying fewer is an error. It returns the total
+// number of bytes written.
+func (us *UploadScheduler[K]) copyChunk(dst io.Writer, chunk io.Reader, limit int64) (int64, error) {
+	copyN := func(remaining int64) (int64, error) {
+		if limit < 0 {
+			return io.Copy(dst, us.source(chunk))
+		}
+		return io.CopyN(dst, us.source(chunk), remaining)
+	}
+
+	p := us.opts.retry
+	seeker, seekable := chunk.(io.Seeker)
+	var start int64
+	if p.attempts > 1 && seekable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	n, err := copyN(limit)
+	backoff := p.backoff
+	for attempt := 1; err != nil && attempt < p.attempts && seekable && p.retryable(err); attempt++ {
+		if _, serr := seeker.Seek(start+n, io.SeekStart); serr != nil {
+			break
+		}
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, p.maxBackoff)
+
+		var m int64
+		m, err = copyN(limit - n)
+		n += m
+	}
+
+	return n, err
+}
+
+// Append appends a chunk of data to the destination writer associated with
+// the given key. It resets the upload's timer to the initial timeout duration
+// upon a successful append. If the key does not exist, an error is returned.
+//
+// Appends to the same upload are performed one at a time, in the order in
+// which they were called; Append blocks until preceding appends have
+// completed, so that chunks accepted in order are written in order. The
+// number of waiting appends can be limited WithAppendQueue.
+//
+// If dst is nil and the scheduler does not manage the upload's destination,
+// ErrNilDestination is returned without consuming the chunk. Failures caused
+// by a destination that has already been closed wrap ErrDestinationClosed.
+//
+// It is recommended to use AppendOpenFlags for actual files that are passed
+// to this function.
+func (us *UploadScheduler[K]) Append(k K, chunk multipart.File, dst io.Writer) error {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return ErrKeyNotExist
+	}
+
+	if err := us.lockAppend(k, u); err != nil {
+		return err
+	}
+	n, d, err := us.append(u, chunk, dst)
+	u.appendMu.Unlock()
+
+	return us.appended(k, n, d, err)
+}
+
+// AppendN appends a chunk like Append and returns the number of bytes of
+// the chunk written to the destination, which is also reported if the append
+// fails partway. Together with the offset reported by Status, this allows
+// building responses that describe the range written by each chunk.
+func (us *UploadScheduler[K]) AppendN(k K, chunk multipart.File, dst io.Writer) (int64, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return 0, ErrKeyNotExist
+	}
+
+	if err := us.lockAppend(k, u); err != nil {
+		return 0, err
+	}
+	n, d, err := us.append(u, chunk, dst)
+	u.appendMu.Unlock()
+
+	return n, us.appended(k, n, d, err)
+}
+
+// TryAppend appends a chunk like Append if no other append to the upload
+// associated with the given key is in progress. Otherwise it returns false
+// immediately without blocking, so that callers can reject concurrent chunks
+// for the same upload, for example with 409 Conflict. If the key does not
+// exist, an error is returned.
+func (us *UploadScheduler[K]) TryAppend(k K, chunk multipart.File, dst io.Writer) (bool, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return false, ErrKeyNotExist
+	}
+
+	if !u.appendMu.TryLock() {
+		return false, nil
+	}
+	n, d, err := us.append(u, chunk, dst)
+	u.appendMu.Unlock()
+
+	return true, us.appended(k, n, d, err)
+}
+
+// AppendFrom appends a chunk read from an arbitrary reader like Append.
+//
+// If the chunk implements io.WriterTo, such as *bytes.Reader or
+// *strings.Reader, it writes itself to the destination directly; otherwise,
+// if the destination implements io.ReaderFrom, such as *os.File, it reads the
+// chunk directly. Either way the chunk is transferred without the 32 KiB
+// intermediate buffer that is used otherwise, which avoids a copy of every
+// byte and, for files on Linux, allows the kernel to move data between file
+// descriptors. The fast path does not apply when a rate limiter is configured
+// WithLimiter, since the chunk is then read in portions permitted by the
+// limiter.
+func (us *UploadScheduler[K]) AppendFrom(k K, chunk io.Reader, dst io.Writer) error {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return ErrKeyNotExist
+	}
+
+	if err := us.lockAppend(k, u); err != nil {
+		return err
+	}
+	n, d, err := us.append(u, chunk, dst)
+	u.appendMu.Unlock()
+
+	return us.appended(k, n, d, err)
+}
+
+// AppendBytes appends a chunk held in memory like Append. The data is
+// passed to a single call of the destination's Write method, without being
+// copied through an intermediate buffer, subject to the exceptions of the fast
+// path described for AppendFrom. The data must not be modified until
+// AppendBytes returns.
+func (us *UploadScheduler[K]) AppendBytes(k K, data []byte, dst io.Writer) error {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return ErrKeyNotExist
+	}
+
+	if err := us.lockAppend(k, u); err != nil {
+		return err
+	}
+	n, d, err := us.append(u, bytes.NewReader(data), dst)
+	u.appendMu.Unlock()
+
+	return us.appended(k, n, d, err)
+}
+
+// lockAppend acquires the append lock of the upload, waiting for preceding
+// appends in the order in which they were called. If the scheduler was
+// configured WithAppendQueue and the queue of the upload is full, it returns
+// ErrAppendQueueFull instead.
+func (us *UploadScheduler[K]) lockAppend(k K, u *upload) error {
+	limit := -1
+	if us.opts.appendQueue > 0 {
+		limit = us.opts.appendQueue
+	}
+	if !u.appendMu.LockQueued(limit) {
+		us.reject(k, RejectConcurrency)
+		return ErrAppendQueueFull
+	}
+	return nil
+}
+
+// reject logs the rejection of a chunk for the given reason and reports it
+// to the hook configured WithOnReject, if any.
+func (us *UploadScheduler[K]) reject(k K, reason RejectReason) {
+	us.opts.logger.Warn("chunk rejected", "key", k, "reason", reason)
+	if us.opts.onReject != nil {
+		us.opts.onReject(k, reason)
+	}
+}
+
+// append copies the chunk to the destination while the upload's expiry is
+// paused, and records the progress. It returns the number of bytes written
+// and the duration of the copy, or ErrKeyNotExist if the upload was finished
+// while waiting for preceding appends. The caller must hold the upload's
+// append lock.
+func (us *UploadScheduler[K]) append(u *upload, chunk io.Reader, dst io.Writer) (int64, time.Duration, error) {
+	u.mu.Lock()
+	if u.finished {
+		u.mu.Unlock()
+		return 0, 0, ErrKeyNotExist
+	}
+	u.stop()
+	if dst == nil {
+		dst = u.dst
+	}
+	if isNil(dst) {
+		u.mu.Unlock()
+		return 0, 0, ErrNilDestination
+	}
+	u.last = dst
+	first := u.written == 0
+	u.mu.Unlock()
+
+	if first && us.opts.inspector != nil {
+		var err error
+		if chunk, err = us.inspect(chunk, sniffLen); err != nil {
+			u.mu.Lock()
+			u.reset(us.opts.now())
+			u.mu.Unlock()
+			return 0, 0, err
+		}
+	}
+
+	if u.hash != nil {
+		dst = hashWriter{w: dst, h: u.hash}
+	}
+
+	begin := time.Now()
+	n, err := us.copyChunk(dst, chunk, -1)
+	d := time.Since(begin)
+
+	if n == 0 && err == nil && us.opts.emptyChunks != CountEmptyChunks {
+		u.mu.Lock()
+		u.resume(us.opts.now())
+		u.mu.Unlock()
+		if us.opts.emptyChunks == RejectEmptyChunks {
+			return 0, d, ErrEmptyChunk
+		}
+		return 0, d, nil
+	}
+
+	u.mu.Lock()
+	u.progress(n, err, us.opts.now())
+	u.mu.Unlock()
+	us.count(n, err)
+	us.touchGroup(u.group)
+
+	return n, d, err
+}
+
+// appended logs the outcome of an append and returns its error, if any. It
+// must be called without holding any of the upload's locks.
+func (us *UploadScheduler[K]) appended(k K, n int64, d time.Duration, err error) error {
+	if errors.Is(err, ErrKeyNotExist) || errors.Is(err, ErrNilDestination) {
+		return err
+	}
+	if errors.Is(err, ErrRejectedContent) {
+		us.reject(k, RejectContent)
+		return err
+	}
+	if errors.Is(err, ErrEmptyChunk) {
+		us.reject(k, RejectEmpty)
+		return err
+	}
+	if err != nil {
+		err = classify(err)
+		us.opts.logger.Error("unable to append chunk", "key", k, "bytes", n, "error", err)
+		return fmt.Errorf("unable to append chunk to destination file: %w", err)
+	}
+
+	us.opts.logger.Debug("chunk appended", "key", k, "bytes", n, "duration", d)
+
+	return nil
+}
+
+// count updates the counters reported by Stats after an append that wrote n
+// bytes and failed with err, if not nil.
+func (us *UploadScheduler[K]) count(n int64, err error) {
+	us.counters.inFlight.Add(n)
+	if err == nil {
+		us.counters.appends.Add(1)
+	}
+}
+
+// inspect reads up to limit leading bytes of the chunk and passes them to
+// the inspector configured WithAppendInspector. It returns a reader that
+// yields the bytes read followed by the rest of the chunk, or
+// ErrRejectedContent if the inspector rejects them.
+func (us *UploadScheduler[K]) inspect(chunk io.Reader, limit int64) (io.Reader, error) {
+	head := make([]byte, min(limit, sniffLen))
+	n, err := io.ReadFull(chunk, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("unable to read chunk: %w", err)
+	}
+	head = head[:n]
+
+	if err := us.opts.inspector(head); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRejectedContent, err)
+	}
+	return io.MultiReader(bytes.NewReader(head), chunk), nil
+}
+
+// isNil reports whether the destination is nil, including nil files, which
+// would otherwise fail with an opaque error.
+func isNil(dst any) bool {
+	if dst == nil {
+		return true
+	}
+	f, ok := dst.(*os.File)
+	return ok && f == nil
+}
+
+// classify wraps errors caused by writing to a closed destination with
+// ErrDestinationClosed.
+func classify(err error) error {
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return fmt.Errorf("%w: %w", ErrDestinationClosed, err)
+	}
+	return err
+}
+
+// AppendPart appends the file of a multipart part to the destination writer
+// associated with the given key, like Append. Before anything is written, the
+// Content-Type declared in the part's header and the type detected from the
+// leading bytes of its content are checked against the types configured with
+// WithDisallowedTypes. If either of them is disallowed, ErrDisallowedType is
+// returned. Detecting the type from the content catches parts that declare a
+// harmless type while carrying a disallowed one.
+func (us *UploadScheduler[K]) AppendPart(k K, part *multipart.FileHeader, dst io.Writer) error {
+	if _, ok := us.m.Get(k); !ok {
+		return ErrKeyNotExist
+	}
+
+	if us.opts.disallowed(part.Header.Get("Content-Type")) {
+		us.reject(k, RejectType)
+		return ErrDisallowedType
+	}
+
+	chunk, err := part.Open()
+	if err != nil {
+		return fmt.Errorf("unable to open chunk: %w", err)
+	}
+	defer chunk.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(chunk, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("unable to read chunk: %w", err)
+	}
+
+	m := mimetype.Detect(head[:n])
+	for _, d := range us.opts.disallowedTypes {
+		if m.Is(d) {
+			us.reject(k, RejectType)
+			return ErrDisallowedType
+		}
+	}
+
+	if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to rewind chunk: %w", err)
+	}
+
+	return us.Append(k, chunk, dst)
+}
+
+// RequestOption configures optional behavior of AppendFromRequest.
+type RequestOption func(*requestOptions)
+
+// requestOptions holds the optional configuration of AppendFromRequest.
+type requestOptions struct {
+	maxMemory   int64
+	maxFormSize int64
+}
+
+// WithMaxMemory configures the number of bytes of a multipart form that
+// AppendFromRequest keeps in memory, beyond which files are stored in
+// temporary files on disk. It defaults to 32 MiB, as used by net/http.
+func WithMaxMemory(n int64) RequestOption {
+	return func(o *requestOptions) {
+		o.maxMemory = n
+	}
+}
+
+// WithMaxFormSize limits the size of the request body parsed by
+// AppendFromRequest, which then returns ErrFormTooLarge for larger requests.
+// By default the size is not limited.
+func WithMaxFormSize(n int64) RequestOption {
+	return func(o *requestOptions) {
+		o.maxFormSize = n
+	}
+}
+
+// AppendFromRequest parses the multipart form of the request and appends the
+// first file of the given field to the upload associated with the given key
+// using AppendPart, so that the checks configured WithDisallowedTypes apply.
+// If the request has no such file, ErrMissingField is returned. Errors of
+// parsing the form, including multipart.ErrMessageTooLarge for forms whose
+// non-file fields are too large, are returned wrapped. Requests exceeding
+// the size configured WithMaxFormSize are reported to the hook configured
+// WithOnReject with RejectSize.
+//
+// Files exceeding the memory configured WithMaxMemory are stored in
+// temporary files, which an http.Server removes once the handler returns.
+// Callers parsing requests outside of a server handler are responsible for
+// removing them by calling RemoveAll on the request's MultipartForm.
+func (us *UploadScheduler[K]) AppendFromRequest(k K, r *http.Request, field string, dst io.Writer, opts ...RequestOption) error {
+	o := requestOptions{maxMemory: 32 << 20}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.maxFormSize > 0 {
+		if r.ContentLength > o.maxFormSize {
+			us.reject(k, RejectSize)
+			return ErrFormTooLarge
+		}
+		r.Body = http.MaxBytesReader(nil, r.Body, o.maxFormSize)
+	}
+
+	if err := r.ParseMultipartForm(o.maxMemory); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			us.reject(k, RejectSize)
+			return ErrFormTooLarge
+		}
+		return fmt.Errorf("unable to parse multipart form: %w", err)
+	}
+
+	files := r.MultipartForm.File[field]
+	if len(files) == 0 {
+		return fmt.Errorf("%w: %s", ErrMissingField, field)
+	}
+
+	return us.AppendPart(k, files[0], dst)
+}
+
+// AppendStream appends each part read from the multipart reader as a chunk
+// to the destination writer associated with the given key, in sequence, until
+// the end of the multipart body. Each part resets the upload's timer like
+// Append. It returns the number of parts appended. If the key does not exist,
+// an error is returned.
+func (us *UploadScheduler[K]) AppendStream(k K, mr *multipart.Reader, dst io.Writer) (int, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return 0, ErrKeyNotExist
+	}
+
+	parts := 0
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return parts, nil
+		}
+		if err != nil {
+			return parts, fmt.Errorf("unable to read part: %w", err)
+		}
+
+		if err := us.lockAppend(k, u); err != nil {
+			part.Close()
+			return parts, err
+		}
+		n, d, err := us.append(u, part, dst)
+		u.appendMu.Unlock()
+		part.Close()
+
+		if err := us.appended(k, n, d, err); err != nil {
+			return parts, err
+		}
+		parts++
+	}
+}
+
+// AppendRange writes a chunk covering the inclusive byte range start-end of
+// an upload of the given total size to the destination, as described by a
+// Content-Range header such as "bytes 100-199/500". A negative total denotes
+// an unknown total size. It resets the upload's timer like Append.
+//
+// The start of the range must equal the number of bytes written so far,
+// otherwise an error wrapping ErrOffsetMismatch that includes the expected
+// offset is returned and nothing is written. This rejects both gapped and
+// overlapping ranges. The chunk must provide exactly end-start+1 bytes, which
+// are written at offset start. Once a total size is known, it is recorded in
+// the upload's status and must not change between ranges.
+//
+// Like all appends to the same upload, ranges are written one at a time.
+func (us *UploadScheduler[K]) AppendRange(k K, start, end, total int64, chunk io.Reader, dst io.WriterAt) error {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return ErrKeyNotExist
+	}
+
+	if start < 0 || end < start || (total >= 0 && end >= total) {
+		return fmt.Errorf("invalid range %d-%d/%d", start, end, total)
+	}
+
+	if err := us.lockAppend(k, u); err != nil {
+		return err
+	}
+	u.mu.Lock()
+
+	if u.finished {
+		u.mu.Unlock()
+		u.appendMu.Unlock()
+		return ErrKeyNotExist
+	}
+
+	if start != u.written {
+		offset := u.written
+		u.mu.Unlock()
+		u.appendMu.Unlock()
+		return fmt.Errorf("%w: expected offset %d, got %d", ErrOffsetMismatch, offset, start)
+	}
+
+	if total >= 0 {
+		if u.total >= 0 && u.total != total {
+			prev := u.total
+			u.mu.Unlock()
+			u.appendMu.Unlock()
+			return fmt.Errorf("total size changed from %d to %d", prev, total)
+		}
+		u.total = total
+	}
+
+	u.stop()
+	if dst == nil {
+		dst, _ = u.dst.(io.WriterAt)
+	}
+	if isNil(dst) {
+		u.mu.Unlock()
+		u.appendMu.Unlock()
+		return ErrNilDestination
+	}
+	u.last = dst
+	u.mu.Unlock()
+
+	if start == 0 && us.opts.inspector != nil {
+		var err error
+		if chunk, err = us.inspect(chunk, end-start+1); err != nil {
+			u.mu.Lock()
+			u.reset(us.opts.now())
+			u.mu.Unlock()
+			u.appendMu.Unlock()
+			if errors.Is(err, ErrRejectedContent) {
+				us.reject(k, RejectContent)
+			}
+			return err
+		}
+	}
+
+	var w io.Writer = io.NewOffsetWriter(dst, start)
+	if u.hash != nil {
+		w = hashWriter{w: w, h: u.hash}
+	}
+
+	begin := time.Now()
+	n, err := us.copyChunk(w, chunk, end-start+1)
+
+	u.mu.Lock()
+	u.progress(n, err, us.opts.now())
+	u.mu.Unlock()
+	us.count(n, err)
+	us.touchGroup(u.group)
+	u.appendMu.Unlock()
+
+	if err != nil {
+		err = classify(err)
+		us.opts.logger.Error("unable to append range", "key", k, "start", start, "bytes", n, "error", err)
+		return fmt.Errorf("unable to write range to destination file: %w", err)
+	}
+
+	us.opts.logger.Debug("range appended", "key", k, "start", start, "bytes", n, "duration", time.Since(begin))
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package upsched
+
+import "sync"
+
+// callbackPool runs queued functions on a fixed number of workers. Its queue
+// is unbounded, so that queueing never blocks. Once stopped, its workers run
+// the functions still queued and exit.
+type callbackPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []func()
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// newCallbackPool creates a callbackPool and starts its workers.
+func newCallbackPool(workers int) *callbackPool {
+	p := &callbackPool{}
+	p.cond = sync.NewCond(&p.mu)
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// dispatch queues f to be run by a worker. It reports false without queueing
+// f if the pool has been stopped.
+func (p *callbackPool) dispatch(f func()) bool {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return false
+	}
+	p.queue = append(p.queue, f)
+	p.mu.Unlock()
+	p.cond.Signal()
+	return true
+}
+
+// work runs queued functions in order of their dispatch until the pool is
+// stopped and its queue is empty.
+func (p *callbackPool) work() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		f := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		f()
+	}
+}
+
+// stop makes the workers exit once they have run all queued functions, and
+// waits for them to do so.
+func (p *callbackPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	p.wg.Wait()
+}
+
+// dispatch runs f on the callback workers configured WithCallbackWorkers,
+// or synchronously if there are none or they have been stopped by Close.
+func (us *UploadScheduler[K]) dispatch(f func()) {
+	if p := us.callbacks.Load(); p == nil || !p.dispatch(f) {
+		f()
+	}
+}
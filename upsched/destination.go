@@ -0,0 +1,260 @@
+package upsched
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TempFileFactory returns a function for use WithWriterFactory that creates
+// the destination of each upload as a new temporary file in the given
+// directory. The files are named "upsched-<key>-<random>.part", with the key
+// encoded as described for TempName, so that GCOrphans can recognize files
+// left behind by uploads that are no longer active, for example after a
+// crash.
+func TempFileFactory[K Key](dir string) func(K) (io.Writer, error) {
+	return func(k K) (io.Writer, error) {
+		return os.CreateTemp(dir, tempPrefix+escapeKey(k)+"-*"+tempSuffix)
+	}
+}
+
+// NamedFileFactory returns a function for use WithWriterFactory that creates
+// the destination of each upload as a new file at the path returned by name
+// for the upload's key, creating its parent directories as needed. This
+// makes the location of destinations predictable, for example
+// "uploads/<key>.part". Files are created exclusively, so if name returns the
+// path of an existing file, such as for two keys mapped to the same path,
+// preparing the upload fails with an error wrapping fs.ErrExist rather than
+// sharing the file. TempName is a suitable name function, whose files
+// GCOrphans recognizes.
+func NamedFileFactory[K Key](name func(K) string) func(K) (io.Writer, error) {
+	return func(k K) (io.Writer, error) {
+		path := name(k)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	}
+}
+
+// TempName returns a name function for use with NamedFileFactory that names
+// the destination of each upload "upsched-<key>.part" in the given directory.
+// The key is formatted by fmt.Sprint and escaped like a URL path segment,
+// with hyphens escaped as well, so that distinct keys never share a name.
+func TempName[K Key](dir string) func(K) string {
+	return func(k K) string {
+		return filepath.Join(dir, tempPrefix+escapeKey(k)+tempSuffix)
+	}
+}
+
+// escapeKey encodes a key for use in a file name. Hyphens are escaped so
+// that they can separate the key from other parts of the name.
+func escapeKey[K Key](k K) string {
+	return strings.ReplaceAll(url.PathEscape(fmt.Sprint(k)), "-", "%2D")
+}
+
+// tempPrefix and tempSuffix delimit the names of files created by
+// TempFileFactory.
+const (
+	tempPrefix = "upsched-"
+	tempSuffix = ".part"
+)
+
+// tempKey returns the formatted key encoded in the name of a file created by
+// TempFileFactory or named by TempName, and whether the name follows their
+// naming convention.
+func tempKey(name string) (string, bool) {
+	name, ok := strings.CutPrefix(name, tempPrefix)
+	if !ok {
+		return "", false
+	}
+	name, ok = strings.CutSuffix(name, tempSuffix)
+	if !ok {
+		return "", false
+	}
+	name, _, _ = strings.Cut(name, "-")
+	k, err := url.PathUnescape(name)
+	if err != nil {
+		return "", false
+	}
+	return k, true
+}
+
+// MemWriter is an in-memory destination for uploads, which is mostly useful
+// for testing. It implements io.Writer, io.WriterAt and a Sync method like
+// *os.File, and is safe for concurrent use. The zero value is an empty
+// MemWriter ready to use.
+type MemWriter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// Write appends p to the content.
+func (mw *MemWriter) Write(p []byte) (int, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	mw.buf = append(mw.buf, p...)
+	return len(p), nil
+}
+
+// WriteAt writes p at the given offset, growing the content as needed. Gaps
+// are filled with zero bytes.
+func (mw *MemWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(mw.buf) {
+		mw.buf = append(mw.buf, make([]byte, end-len(mw.buf))...)
+	}
+	return copy(mw.buf[off:], p), nil
+}
+
+// Sync does nothing, since the content is always in memory.
+func (mw *MemWriter) Sync() error {
+	return nil
+}
+
+// Bytes returns a copy of the content.
+func (mw *MemWriter) Bytes() []byte {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	return bytes.Clone(mw.buf)
+}
+
+// Len returns the length of the content.
+func (mw *MemWriter) Len() int {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	return len(mw.buf)
+}
+
+// destinationFile returns the destination of an upload if it is a file. The
+// managed destination takes precedence over the destination last appended to.
+func destinationFile(managed io.Writer, last any) (*os.File, bool) {
+	dst := last
+	if !isNil(managed) {
+		dst = managed
+	}
+
+	f, ok := dst.(*os.File)
+	return f, ok && f != nil
+}
+
+// SetDestination replaces the destination of the upload associated with the
+// given key, which appends use when they are not given one, for example to
+// continue in a new part file once the current one is large enough. Appends
+// called before SetDestination complete on the previous destination, while
+// later ones use the new one. The previous destination is not closed; if it
+// was created WithWriterFactory, closing it is up to the caller, while the
+// new one is closed when the upload is finalized. Since the size checked
+// WithSizeCheck is that of the whole upload, the check fails for uploads
+// whose destination was replaced. If the key does not exist, an error is
+// returned.
+func (us *UploadScheduler[K]) SetDestination(k K, dst io.Writer) error {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return ErrKeyNotExist
+	}
+	if isNil(dst) {
+		return ErrNilDestination
+	}
+
+	u.appendMu.Lock()
+	defer u.appendMu.Unlock()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.finished {
+		return ErrKeyNotExist
+	}
+	u.dst = dst
+
+	return nil
+}
+
+// DestinationPath returns the name of the file the upload associated with
+// the given key writes to, as reported by the Name method of *os.File, for
+// troubleshooting. The destination is the one managed by the scheduler, if
+// any, or else the one most recently appended to. It returns false if the key
+// does not exist or the destination is not an *os.File.
+func (us *UploadScheduler[K]) DestinationPath(k K) (string, bool) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return "", false
+	}
+
+	u.mu.Lock()
+	f, ok := destinationFile(u.dst, u.last)
+	u.mu.Unlock()
+
+	if !ok {
+		return "", false
+	}
+	return f.Name(), true
+}
+
+// GCOrphans removes the files in the given directory that were created by
+// TempFileFactory or named by TempName for uploads that are not active in this
+// scheduler, and that were last modified longer ago than olderThan. Such files
+// are left behind when uploads expire without their destinations being
+// removed, or when the process crashes. Files not following the naming
+// convention of these functions are never removed. It returns the number of files removed,
+// along with the errors of files that could not be removed joined together.
+func (us *UploadScheduler[K]) GCOrphans(dir string, olderThan time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read directory: %w", err)
+	}
+
+	active := make(map[string]bool)
+	us.m.ForEach(func(k K, _ *upload) bool {
+		active[fmt.Sprint(k)] = true
+		return true
+	})
+
+	cutoff := us.opts.now().Add(-olderThan)
+	var removed int
+	var errs []error
+	for _, e := range entries {
+		k, ok := tempKey(e.Name())
+		if !ok || !e.Type().IsRegular() || active[k] {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if !fi.ModTime().Before(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+		us.opts.logger.Debug("orphaned upload file removed", "file", e.Name())
+	}
+
+	return removed, errors.Join(errs...)
+}
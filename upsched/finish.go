@@ -0,0 +1,429 @@
+package upsched
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Manifest describes a finished upload, as written by Finish if the
+// scheduler was configured WithManifest.
+type Manifest struct {
+	Size     int64     `json:"size"`
+	Chunks   int       `json:"chunks"`
+	SHA256   string    `json:"sha256"`
+	Finished time.Time `json:"finished"`
+}
+
+// hashWriter writes to a destination and hashes the bytes accepted by it.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+// Write writes p to the destination and hashes the bytes written.
+func (hw hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+// Finish finalizes the upload associated with the given key. It waits for
+// an append in progress to complete, stops the associated timer and removes
+// the upload from the scheduler's internal map. If the key does not exist, an
+// error is returned.
+//
+// If the destination of the upload is managed by the scheduler and implements
+// io.Closer, it is closed. Since buffered destinations may only write their
+// data when closed, a failure to close is returned as an error wrapping
+// ErrFinalizeClose, even though the upload is removed regardless. Likewise,
+// a size mismatch detected WithSizeCheck or a failure to write the manifest
+// configured WithManifest is returned after the upload is removed.
+func (us *UploadScheduler[K]) Finish(k K) error {
+	found, err := us.finalize(k, byFinish)
+	if !found {
+		return ErrKeyNotExist
+	}
+	return err
+}
+
+// Flush finalizes the upload associated with the given key like Finish, for
+// administrative use when an upload must be completed on behalf of a client
+// that will not finish it. It differs from Finish only in that it is logged as
+// a distinct "upload flushed" event, so that forced completions can be told
+// apart from those requested by clients.
+func (us *UploadScheduler[K]) Flush(k K) error {
+	found, err := us.finalize(k, byFlush)
+	if !found {
+		return ErrKeyNotExist
+	}
+	return err
+}
+
+// FinishWith finishes the upload associated with the given key like
+// Finish, but first runs post, such as generating a thumbnail or validating
+// the upload, as part of the finalization. It waits for an append in progress
+// to complete and pauses the upload's expiry while post runs, during which
+// appends wait. The upload is only finalized if post succeeds; otherwise the
+// upload remains active with its timer reset, so that the client can retry or
+// cancel it, and the error of post is returned wrapped. Since post runs before
+// the destination is closed, it sees the data written so far, but buffered
+// destinations may not have flushed it yet. If the key does not exist, an
+// error is returned.
+func (us *UploadScheduler[K]) FinishWith(k K, post func(K) error) error {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return ErrKeyNotExist
+	}
+
+	u.appendMu.Lock()
+
+	u.mu.Lock()
+	if u.finished {
+		u.mu.Unlock()
+		u.appendMu.Unlock()
+		return ErrKeyNotExist
+	}
+	u.stop()
+	u.mu.Unlock()
+
+	if err := post(k); err != nil {
+		u.mu.Lock()
+		u.reset(us.opts.now())
+		u.mu.Unlock()
+		u.appendMu.Unlock()
+
+		us.opts.logger.Error("unable to post-process upload", "key", k, "error", err)
+		return fmt.Errorf("unable to post-process upload: %w", err)
+	}
+
+	ok = us.remove(k, u)
+	u.appendMu.Unlock()
+
+	if !ok {
+		return ErrKeyNotExist
+	}
+	return us.complete(k, u, byFinish)
+}
+
+// Checkpoint makes the data appended so far to the upload associated with
+// the given key durable without finalizing the upload, for long-running
+// uploads that want periodic durability points. It waits for an append in
+// progress to complete, syncs the destination to stable storage if it has a
+// Sync method, as *os.File does, and resets the upload's timer like an append.
+// It returns the number of bytes written so far. If the key does not exist, an
+// error is returned.
+func (us *UploadScheduler[K]) Checkpoint(k K) (int64, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return 0, ErrKeyNotExist
+	}
+
+	u.appendMu.Lock()
+	defer u.appendMu.Unlock()
+
+	u.mu.Lock()
+	if u.finished {
+		u.mu.Unlock()
+		return 0, ErrKeyNotExist
+	}
+	var dst any = u.dst
+	if isNil(dst) {
+		dst = u.last
+	}
+	u.stop()
+	u.mu.Unlock()
+
+	var err error
+	if s, ok := dst.(interface{ Sync() error }); ok && !isNil(dst) {
+		err = s.Sync()
+	}
+
+	u.mu.Lock()
+	u.reset(us.opts.now())
+	written := u.written
+	u.mu.Unlock()
+	us.touchGroup(u.group)
+
+	if err != nil {
+		err = classify(err)
+		us.opts.logger.Error("unable to sync upload destination", "key", k, "error", err)
+		return written, fmt.Errorf("unable to sync upload destination: %w", err)
+	}
+
+	us.opts.logger.Debug("upload checkpointed", "key", k, "bytes", written)
+
+	return written, nil
+}
+
+// finalization describes the cause of finalizing an upload.
+type finalization int
+
+const (
+	// byFinish denotes an upload finished by the client.
+	byFinish finalization = iota
+	// byFlush denotes an upload finished administratively.
+	byFlush
+	// byExpiry denotes an upload that timed out.
+	byExpiry
+	// byClose denotes an upload discarded by the scheduler, for example
+	// when it is closed.
+	byClose
+)
+
+// finalize finalizes the upload associated with the given key as described
+// for Finish. The manifest configured WithManifest is only written for
+// uploads finished by the client or flushed. It reports whether the key
+// existed, and returns the error of closing the destination, if any.
+func (us *UploadScheduler[K]) finalize(k K, by finalization) (bool, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return false, nil
+	}
+
+	return us.finalizeUpload(k, u, by)
+}
+
+// finalizeUpload finalizes the given upload, which is associated with the
+// given key unless it has been finalized or rekeyed meanwhile, in which case
+// it reports that the key did not exist.
+func (us *UploadScheduler[K]) finalizeUpload(k K, u *upload, by finalization) (bool, error) {
+	u.appendMu.Lock()
+	ok := us.remove(k, u)
+	u.appendMu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	return true, us.complete(k, u, by)
+}
+
+// expireUpload finalizes the given upload as expired under its current key,
+// which it returns along with the results of finalizeUpload. An upload that is
+// rekeyed while it expires is finalized under its new key.
+func (us *UploadScheduler[K]) expireUpload(u *upload) (K, bool, error) {
+	for {
+		u.mu.Lock()
+		k, finished := u.key.(K), u.finished
+		u.mu.Unlock()
+		if finished {
+			return k, false, nil
+		}
+
+		found, err := us.finalizeUpload(k, u, byExpiry)
+		if found {
+			return k, true, err
+		}
+
+		u.mu.Lock()
+		rekeyed := !u.finished && u.key.(K) != k
+		u.mu.Unlock()
+		if !rekeyed {
+			return k, false, nil
+		}
+	}
+}
+
+// remove removes the upload from the scheduler and stops its timers,
+// reporting whether it was still associated with the given key. The caller
+// must hold the upload's append lock.
+func (us *UploadScheduler[K]) remove(k K, u *upload) bool {
+	if v, ok := us.m.Get(k); !ok || v != u {
+		return false
+	}
+	us.m.Del(k)
+
+	u.mu.Lock()
+	u.stop()
+	if u.lifetime != nil {
+		u.lifetime.Stop()
+	}
+	u.finished = true
+	u.mu.Unlock()
+
+	return true
+}
+
+// complete completes the finalization of an upload that has been removed,
+// returning the error of closing the destination, if any.
+func (us *UploadScheduler[K]) complete(k K, u *upload, by finalization) error {
+	if u.group != "" {
+		us.leave(u.group, k)
+	}
+	us.checkDrained()
+
+	written, created, dst := u.written, u.created, u.dst
+
+	us.counters.inFlight.Add(-written)
+	if by == byFinish || by == byFlush {
+		us.counters.finishes.Add(1)
+	}
+
+	// The destination may have been replaced since it was preallocated.
+	f, prealloc := dst.(*os.File)
+	prealloc = prealloc && u.prealloc
+
+	if prealloc && (by == byFinish || by == byFlush) {
+		if err := f.Truncate(written); err != nil {
+			us.opts.logger.Error("unable to truncate upload destination", "key", k, "error", err)
+		}
+	}
+
+	var sizeErr error
+	if us.opts.sizeCheck && (by == byFinish || by == byFlush) {
+		sizeErr = checkSize(dst, u.last, written)
+		if sizeErr != nil {
+			us.opts.logger.Warn("upload size mismatch", "key", k, "error", sizeErr)
+		}
+	}
+
+	var closeErr error
+	if c, ok := dst.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			us.opts.logger.Error("unable to close upload destination", "key", k, "error", err)
+			closeErr = fmt.Errorf("%w: %w", ErrFinalizeClose, err)
+		}
+	}
+
+	// The preallocated file is removed even if closing it failed, since it
+	// would otherwise be left behind at its full size.
+	if prealloc && by == byExpiry {
+		if err := os.Remove(f.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			us.opts.logger.Error("unable to remove preallocated upload destination", "key", k, "error", err)
+		}
+	}
+
+	if closeErr != nil {
+		return errors.Join(sizeErr, closeErr)
+	}
+
+	if sizeErr != nil {
+		return sizeErr
+	}
+
+	if (by == byFinish || by == byFlush) && us.opts.scanner != nil {
+		if err := us.scan(k, dst, u.last); err != nil {
+			return err
+		}
+	}
+
+	if (by == byFinish || by == byFlush) && us.opts.manifestPath != nil {
+		if err := us.writeManifest(k, u); err != nil {
+			us.opts.logger.Error("unable to write upload manifest", "key", k, "error", err)
+			return err
+		}
+	}
+
+	msg := "upload finished"
+	if by == byFlush {
+		msg = "upload flushed"
+	}
+	us.opts.logger.Info(msg, "key", k, "bytes", written, "duration", us.opts.now().Sub(created))
+
+	return nil
+}
+
+// scan scans the destination of the finalized upload with the configured
+// scanner, removing it if the scan fails.
+func (us *UploadScheduler[K]) scan(k K, managed io.Writer, last any) error {
+	f, ok := destinationFile(managed, last)
+	if !ok {
+		return nil
+	}
+
+	err := us.opts.scanner.Scan(f.Name())
+	if err == nil {
+		return nil
+	}
+
+	us.opts.logger.Warn("upload rejected by scanner", "key", k, "file", f.Name(), "error", err)
+	if rmErr := os.Remove(f.Name()); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+		us.opts.logger.Error("unable to remove rejected upload", "key", k, "error", rmErr)
+	}
+	return fmt.Errorf("%w: %w", ErrScanFailed, err)
+}
+
+// writeManifest writes the manifest of the finalized upload to the path
+// configured for its key.
+func (us *UploadScheduler[K]) writeManifest(k K, u *upload) error {
+	b, err := json.Marshal(Manifest{
+		Size:     u.written,
+		Chunks:   u.appends,
+		SHA256:   hex.EncodeToString(u.hash.Sum(nil)),
+		Finished: us.opts.now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(us.opts.manifestPath(k), b, 0o644); err != nil {
+		return fmt.Errorf("unable to write upload manifest: %w", err)
+	}
+
+	return nil
+}
+
+// checkSize returns ErrSizeMismatch if the destination of an upload is a
+// file whose size differs from the number of bytes written. The managed
+// destination takes precedence over the destination last appended to.
+func checkSize(managed io.Writer, last any, written int64) error {
+	f, ok := destinationFile(managed, last)
+	if !ok {
+		return nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat upload destination: %w", err)
+	}
+	if fi.Size() != written {
+		return fmt.Errorf("%w: wrote %d bytes, destination has %d bytes", ErrSizeMismatch, written, fi.Size())
+	}
+
+	return nil
+}
+
+// FinishAll finalizes the uploads associated with the given keys in order,
+// so that related uploads can be treated as a unit. By default it stops at the
+// first key that cannot be finished and returns its error. If the scheduler
+// was configured WithContinueOnError, it attempts every key and returns the
+// errors of all failed keys joined together.
+//
+// Finalizing a set of uploads is not atomic: when an error is returned, the
+// uploads preceding the failed key have already been finalized and cannot be
+// restored. Callers that need all-or-nothing semantics must compensate, for
+// example by discarding the destinations of all keys of a failed set.
+func (us *UploadScheduler[K]) FinishAll(keys []K) error {
+	var errs []error
+	for _, k := range keys {
+		if err := us.Finish(k); err != nil {
+			err = fmt.Errorf("unable to finish upload %v: %w", k, err)
+			if !us.opts.continueOnError {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Cancel finalizes the upload associated with the given key like an upload
+// that timed out, calling its timeout callback with an error wrapping
+// ErrCanceled, so that the callback can discard the incomplete destination.
+// If the key does not exist, an error is returned.
+func (us *UploadScheduler[K]) Cancel(k K) error {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return ErrKeyNotExist
+	}
+	u.expire(ErrCanceled)
+	return nil
+}
@@ -0,0 +1,128 @@
+package upsched
+
+import "time"
+
+// group holds the keys of the members of an upload group and the timer of
+// its timeout, which is nil if the group has none.
+type group[K Key] struct {
+	timeout time.Duration
+	timer   *time.Timer
+	members map[K]struct{}
+}
+
+// join adds the key to the group with the given name, creating the group
+// with the given timeout if it does not exist.
+func (us *UploadScheduler[K]) join(name string, timeout time.Duration, k K) {
+	us.groupsMu.Lock()
+	defer us.groupsMu.Unlock()
+
+	g, ok := us.groups[name]
+	if !ok {
+		g = &group[K]{timeout: timeout, members: make(map[K]struct{})}
+		if timeout > 0 {
+			g.timer = time.AfterFunc(timeout, func() { us.expireGroup(name, g) })
+		}
+		if us.groups == nil {
+			us.groups = make(map[string]*group[K])
+		}
+		us.groups[name] = g
+	}
+	g.members[k] = struct{}{}
+}
+
+// leave removes the key from the group with the given name, removing the
+// group once it has no members left.
+func (us *UploadScheduler[K]) leave(name string, k K) {
+	us.groupsMu.Lock()
+	defer us.groupsMu.Unlock()
+
+	g, ok := us.groups[name]
+	if !ok {
+		return
+	}
+	delete(g.members, k)
+	if len(g.members) == 0 {
+		if g.timer != nil {
+			g.timer.Stop()
+		}
+		delete(us.groups, name)
+	}
+}
+
+// regroup replaces the old key with the new key in the group with the given
+// name.
+func (us *UploadScheduler[K]) regroup(name string, old, new K) {
+	us.groupsMu.Lock()
+	defer us.groupsMu.Unlock()
+
+	if g, ok := us.groups[name]; ok {
+		delete(g.members, old)
+		g.members[new] = struct{}{}
+	}
+}
+
+// touchGroup restarts the timeout of the group with the given name.
+func (us *UploadScheduler[K]) touchGroup(name string) {
+	if name == "" {
+		return
+	}
+
+	us.groupsMu.Lock()
+	defer us.groupsMu.Unlock()
+
+	if g, ok := us.groups[name]; ok && g.timer != nil {
+		g.timer.Reset(g.timeout)
+	}
+}
+
+// members returns the keys of the members of the group with the given name.
+func (us *UploadScheduler[K]) members(name string) []K {
+	us.groupsMu.Lock()
+	defer us.groupsMu.Unlock()
+
+	g, ok := us.groups[name]
+	if !ok {
+		return nil
+	}
+	keys := make([]K, 0, len(g.members))
+	for k := range g.members {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// expireGroup removes the given group, unless it has already been replaced
+// by a group with the same name, and expires all of its members.
+func (us *UploadScheduler[K]) expireGroup(name string, g *group[K]) {
+	us.groupsMu.Lock()
+	if us.groups[name] != g {
+		us.groupsMu.Unlock()
+		return
+	}
+	delete(us.groups, name)
+	us.groupsMu.Unlock()
+
+	us.opts.logger.Info("upload group timed out", "group", name, "members", len(g.members))
+
+	for k := range g.members {
+		if u, ok := us.m.Get(k); ok {
+			u.expire(ErrGroupTimeout)
+		}
+	}
+}
+
+// FinishGroup finishes all members of the group with the given name, as
+// done by FinishAll, in no particular order. If the group does not exist, for
+// example because all of its members have been finalized, it does nothing.
+func (us *UploadScheduler[K]) FinishGroup(g string) error {
+	return us.FinishAll(us.members(g))
+}
+
+// CancelGroup cancels all members of the group with the given name, as done
+// by Cancel. If the group does not exist, it does nothing.
+func (us *UploadScheduler[K]) CancelGroup(g string) {
+	for _, k := range us.members(g) {
+		// Members finalized in the meantime are skipped.
+		_ = us.Cancel(k)
+	}
+}
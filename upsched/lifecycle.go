@@ -0,0 +1,156 @@
+package upsched
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Drain makes the scheduler reject new uploads with ErrDraining, while
+// active uploads can still be appended to and finished as usual. Once the
+// last active upload has been finalized, the channel returned by DrainedDone
+// is closed. Draining lasts until the scheduler is reset.
+func (us *UploadScheduler[K]) Drain() {
+	us.mu.Lock()
+	if !us.draining {
+		us.draining = true
+		us.drainMu.Lock()
+		us.drained = make(chan struct{})
+		us.isDrained = false
+		us.drainMu.Unlock()
+	}
+	us.mu.Unlock()
+
+	us.checkDrained()
+}
+
+// DrainedDone returns a channel that is closed once the scheduler is
+// draining and no uploads are active anymore. It returns nil if Drain has not
+// been called.
+func (us *UploadScheduler[K]) DrainedDone() <-chan struct{} {
+	us.drainMu.Lock()
+	defer us.drainMu.Unlock()
+
+	return us.drained
+}
+
+// checkDrained closes the channel returned by DrainedDone if the scheduler
+// is draining and no uploads are active anymore.
+func (us *UploadScheduler[K]) checkDrained() {
+	us.drainMu.Lock()
+	defer us.drainMu.Unlock()
+
+	if us.drained != nil && !us.isDrained && us.m.Len() == 0 {
+		close(us.drained)
+		us.isDrained = true
+	}
+}
+
+// Close finalizes all active uploads without invoking their timeout
+// callbacks, stops the sweeper and makes the scheduler reject new uploads
+// with ErrClosed, until it is reset. If the scheduler uses callback workers,
+// Close waits for the callbacks already dispatched to them to complete and
+// stops the workers, so it must not be called from such a callback. Callbacks
+// of uploads that expire while the scheduler closes are invoked
+// synchronously. It returns the errors of finalizing the uploads joined
+// together. Closing a closed scheduler has no effect.
+func (us *UploadScheduler[K]) Close() error {
+	us.mu.Lock()
+	if us.closed {
+		us.mu.Unlock()
+		return nil
+	}
+	us.closed = true
+	if us.stopSweep != nil {
+		close(us.stopSweep)
+		us.stopSweep = nil
+	}
+	detached := us.detachAll()
+	p := us.callbacks.Swap(nil)
+	us.mu.Unlock()
+
+	err := us.completeAll(detached)
+
+	// The workers are stopped without holding the mutex, so that queued
+	// callbacks may still call methods such as Exists or Prepare.
+	if p != nil {
+		p.stop()
+	}
+
+	return err
+}
+
+// Reset makes a closed or draining scheduler usable again, restarting its
+// sweeper and callback workers if configured. Reset may also be called on a
+// scheduler that is neither. If uploads are still active, it returns
+// ErrActiveUploads, unless force is true, in which case they are finalized
+// like by Close.
+func (us *UploadScheduler[K]) Reset(force bool) error {
+	us.mu.Lock()
+
+	var detached []detachedUpload[K]
+	if us.m.Len() > 0 {
+		if !force {
+			us.mu.Unlock()
+			return ErrActiveUploads
+		}
+		detached = us.detachAll()
+	}
+
+	if us.closed {
+		us.closed = false
+		us.start()
+	}
+	if us.draining {
+		us.draining = false
+		us.drainMu.Lock()
+		us.drained = nil
+		us.drainMu.Unlock()
+	}
+	us.mu.Unlock()
+
+	return us.completeAll(detached)
+}
+
+// detachedUpload is an upload removed from the scheduler by detachAll, along
+// with its key.
+type detachedUpload[K Key] struct {
+	k K
+	u *upload
+}
+
+// detachAll removes all active uploads from the scheduler without invoking
+// their timeout callbacks, and returns them to be finalized by completeAll.
+// The caller must hold the scheduler's mutex, which it must release before
+// calling completeAll, so that nothing is logged while holding it.
+func (us *UploadScheduler[K]) detachAll() []detachedUpload[K] {
+	var detached []detachedUpload[K]
+	us.m.ForEach(func(k K, u *upload) bool {
+		detached = append(detached, detachedUpload[K]{k: k, u: u})
+		return true
+	})
+
+	n := 0
+	for _, d := range detached {
+		d.u.appendMu.Lock()
+		ok := us.remove(d.k, d.u)
+		d.u.appendMu.Unlock()
+		if ok {
+			detached[n] = d
+			n++
+		}
+	}
+	return detached[:n]
+}
+
+// completeAll completes the finalization of the uploads returned by
+// detachAll, and returns the errors of finalizing them joined together.
+func (us *UploadScheduler[K]) completeAll(detached []detachedUpload[K]) error {
+	var errs []error
+	for _, d := range detached {
+		if err := us.complete(d.k, d.u, byClose); err != nil {
+			errs = append(errs, fmt.Errorf("unable to finish upload %v: %w", d.k, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package upsched
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ParseUploadMetadata parses the value of an Upload-Metadata header as
+// defined by the tus resumable upload protocol, which consists of
+// comma-separated pairs of a key and a base64 encoded value, separated by a
+// space. The value of a pair may be omitted, in which case the key maps to an
+// empty string. Keys must be non-empty, unique and consist of printable ASCII
+// characters other than spaces and commas. If the header violates this or a
+// value is not valid standard base64, ErrInvalidMetadata is returned. An
+// empty header yields an empty map.
+func ParseUploadMetadata(header string) (map[string]string, error) {
+	md := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return md, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if !validMetadataKey(key) {
+			return nil, fmt.Errorf("%w: invalid key %q", ErrInvalidMetadata, key)
+		}
+		if _, ok := md[key]; ok {
+			return nil, fmt.Errorf("%w: duplicate key %q", ErrInvalidMetadata, key)
+		}
+
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid value of key %q: %w", ErrInvalidMetadata, key, err)
+		}
+		md[key] = string(b)
+	}
+
+	return md, nil
+}
+
+// FormatUploadMetadata formats the given metadata as the value of an
+// Upload-Metadata header, as parsed by ParseUploadMetadata. Pairs are sorted
+// by key, and empty values are omitted along with their separating space.
+// Keys that ParseUploadMetadata would reject are skipped.
+func FormatUploadMetadata(md map[string]string) string {
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		if validMetadataKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var b strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(key)
+		if v := md[key]; v != "" {
+			b.WriteByte(' ')
+			b.WriteString(base64.StdEncoding.EncodeToString([]byte(v)))
+		}
+	}
+	return b.String()
+}
+
+// validMetadataKey reports whether key is a valid key of upload metadata.
+func validMetadataKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c <= ' ' || c > '~' || c == ',' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package upsched
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MultiScheduler routes uploads of several tenants to a separate Scheduler
+// per tenant, so that the keys, options and lifecycle of each tenant are
+// isolated from the others. The scheduler of a tenant is created when it is
+// first used. A MultiScheduler must be created with NewMultiScheduler and is
+// safe for concurrent use.
+type MultiScheduler[T comparable, K Key] struct {
+	mu         sync.Mutex
+	schedulers map[T]*UploadScheduler[K]
+	opts       func(T) []Option[K]
+}
+
+// NewMultiScheduler creates a new MultiScheduler that configures the
+// scheduler of each tenant with the options returned by opts for the tenant,
+// which may be nil to use the default options for all tenants.
+func NewMultiScheduler[T comparable, K Key](opts func(T) []Option[K]) *MultiScheduler[T, K] {
+	return &MultiScheduler[T, K]{
+		schedulers: make(map[T]*UploadScheduler[K]),
+		opts:       opts,
+	}
+}
+
+// Tenant returns the scheduler of the given tenant, creating it if needed.
+func (ms *MultiScheduler[T, K]) Tenant(t T) *UploadScheduler[K] {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s, ok := ms.schedulers[t]
+	if !ok {
+		var opts []Option[K]
+		if ms.opts != nil {
+			opts = ms.opts(t)
+		}
+		s = NewScheduler[K](opts...)
+		ms.schedulers[t] = s
+	}
+	return s
+}
+
+// Len returns the number of active uploads of all tenants.
+func (ms *MultiScheduler[T, K]) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var n int
+	for _, s := range ms.schedulers {
+		n += s.Len()
+	}
+	return n
+}
+
+// Stats returns the sum of the statistics of the schedulers of all tenants.
+// The counters of tenants that have been removed are not included.
+func (ms *MultiScheduler[T, K]) Stats() SchedulerStats {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var stats SchedulerStats
+	for _, s := range ms.schedulers {
+		st := s.Stats()
+		stats.Active += st.Active
+		stats.BytesInFlight += st.BytesInFlight
+		stats.Appends += st.Appends
+		stats.Timeouts += st.Timeouts
+		stats.Finishes += st.Finishes
+	}
+	return stats
+}
+
+// Remove closes the scheduler of the given tenant, as done by Close, and
+// removes it, so that the next use of the tenant creates a new scheduler.
+// Removing a tenant without a scheduler has no effect.
+func (ms *MultiScheduler[T, K]) Remove(t T) error {
+	ms.mu.Lock()
+	s, ok := ms.schedulers[t]
+	delete(ms.schedulers, t)
+	ms.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return s.Close()
+}
+
+// Close closes and removes the schedulers of all tenants, returning their
+// errors joined together.
+func (ms *MultiScheduler[T, K]) Close() error {
+	ms.mu.Lock()
+	schedulers := ms.schedulers
+	ms.schedulers = make(map[T]*UploadScheduler[K])
+	ms.mu.Unlock()
+
+	var errs []error
+	for t, s := range schedulers {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to close scheduler of tenant %v: %w", t, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,407 @@
+package upsched
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Option configures optional behavior of an UploadScheduler. Options are
+// typed by the key type of the scheduler, so an option taking keys of another
+// type does not compile.
+type Option[K Key] func(*options[K])
+
+// options holds the optional configuration of a scheduler.
+type options[K Key] struct {
+	disallowedTypes []string
+	limiter         *rate.Limiter
+	continueOnError bool
+	logger          *slog.Logger
+	retry           retryPolicy
+	sweepInterval   time.Duration
+	coalesce        time.Duration
+	callbackWorkers int
+	writerFactory   func(K) (io.Writer, error)
+	now             func() time.Time
+	sizeCheck       bool
+	manifestPath    func(K) string
+	checksum        bool
+	appendQueue     int
+	onReject        func(K, RejectReason)
+	inspector       func(head []byte) error
+	emptyChunks     EmptyChunkPolicy
+	scanner         Scanner
+}
+
+// retryPolicy describes how failed copies of a chunk are retried.
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	retryable  func(error) bool
+}
+
+// WithDisallowedTypes configures the MIME types that AppendPart rejects.
+// Types are compared without their parameters and case-insensitively.
+func WithDisallowedTypes[K Key](types ...string) Option[K] {
+	return func(o *options[K]) {
+		o.disallowedTypes = append(o.disallowedTypes, types...)
+	}
+}
+
+// WithLimiter configures a rate limiter, in bytes per second, shared by all
+// uploads of the scheduler. Every append draws tokens from it before writing,
+// so the aggregate write rate of all uploads stays under the limiter's rate.
+// The same limiter may be shared between several schedulers.
+func WithLimiter[K Key](l *rate.Limiter) Option[K] {
+	return func(o *options[K]) {
+		o.limiter = l
+	}
+}
+
+// WithContinueOnError makes FinishAll attempt to finish every key and
+// report all failures, instead of stopping at the first failure.
+func WithContinueOnError[K Key]() Option[K] {
+	return func(o *options[K]) {
+		o.continueOnError = true
+	}
+}
+
+// WithRetry configures appends to retry copying a chunk up to the given
+// total number of attempts when the copy fails with an error for which
+// retryable returns true. Other errors fail immediately. The delay before the
+// first retry is backoff, and it doubles for every further retry without
+// exceeding maxBackoff.
+//
+// A retry resumes after the bytes already written to the destination. This
+// requires the chunk to implement io.Seeker, which multipart.File always
+// does; chunks that cannot be rewound are not retried.
+func WithRetry[K Key](attempts int, backoff, maxBackoff time.Duration, retryable func(error) bool) Option[K] {
+	return func(o *options[K]) {
+		o.retry = retryPolicy{
+			attempts:   attempts,
+			backoff:    backoff,
+			maxBackoff: maxBackoff,
+			retryable:  retryable,
+		}
+	}
+}
+
+// WithSweeper makes the scheduler expire uploads using a single background
+// sweeper that checks the deadlines of all uploads at the given interval,
+// instead of a timer per upload. This avoids allocating a timer for each of a
+// large number of concurrent uploads, at the cost of uploads expiring up to
+// one interval after their deadline. The timeout callbacks behave the same in
+// both modes. The sweeper runs until the scheduler is closed.
+func WithSweeper[K Key](interval time.Duration) Option[K] {
+	return func(o *options[K]) {
+		o.sweepInterval = interval
+	}
+}
+
+// WithCoalescedResets reduces the overhead of many small appends by
+// restarting the timer of an upload at most once per the given interval,
+// instead of stopping it before and restarting it after every append. The
+// deadline of the upload is still extended by every append; when the timer
+// fires before the deadline, it is rearmed for the remaining time instead of
+// expiring the upload. An upload therefore never expires early, but the timer
+// may fire up to once more per timeout than otherwise. It has no effect on
+// schedulers configured WithSweeper, whose uploads have no timers.
+func WithCoalescedResets[K Key](interval time.Duration) Option[K] {
+	return func(o *options[K]) {
+		o.coalesce = interval
+	}
+}
+
+// WithCallbackWorkers makes the scheduler dispatch timeout callbacks to a
+// pool of the given number of worker goroutines, instead of invoking them
+// synchronously from the goroutine that expired the upload. Expired uploads
+// are still finalized before their callback is dispatched, and dispatching
+// never blocks, so slow callbacks cannot delay further timeouts.
+//
+// When callbacks are invoked synchronously, each callback runs in the timer
+// goroutine of its upload, or sequentially in the sweeper goroutine if
+// WithSweeper is used. When they are dispatched, callbacks are started in the
+// order their uploads expired; with a single worker they also complete in
+// that order, while multiple workers may run them concurrently.
+func WithCallbackWorkers[K Key](n int) Option[K] {
+	return func(o *options[K]) {
+		o.callbackWorkers = n
+	}
+}
+
+// WithWriterFactory makes the scheduler manage the destinations of uploads.
+// Prepare calls f to create the destination of each upload, which appends use
+// whenever they are passed a nil destination. When the upload is finalized,
+// the destination is closed if it implements io.Closer.
+func WithWriterFactory[K Key](f func(K) (io.Writer, error)) Option[K] {
+	return func(o *options[K]) {
+		o.writerFactory = f
+	}
+}
+
+// WithSizeCheck makes Finish and Flush verify that the size of the
+// destination of an upload matches the number of bytes written to it,
+// returning ErrSizeMismatch with both sizes otherwise. Uploads that expire or
+// are discarded are not checked. This catches partial writes and destinations
+// that were modified externally. The check applies only to destinations that
+// are *os.File, which are expected to be empty when the upload is prepared;
+// the destination checked is the one managed by the scheduler, if any, or
+// else the one most recently appended to.
+func WithSizeCheck[K Key]() Option[K] {
+	return func(o *options[K]) {
+		o.sizeCheck = true
+	}
+}
+
+// WithAppendQueue limits the number of appends to the same upload that
+// wait while another append is in progress. Appends beyond the limit fail
+// with ErrAppendQueueFull instead of waiting, which protects the scheduler
+// from overload by clients sending many concurrent chunks. By default, or if
+// n is not positive, the number of waiting appends is not limited.
+func WithAppendQueue[K Key](n int) Option[K] {
+	return func(o *options[K]) {
+		o.appendQueue = n
+	}
+}
+
+// RejectReason describes which limit caused a chunk to be rejected, as
+// reported to the hook configured WithOnReject.
+type RejectReason string
+
+const (
+	// RejectType denotes a chunk whose content type is disallowed, as
+	// configured WithDisallowedTypes.
+	RejectType RejectReason = "type"
+	// RejectSize denotes a request whose body exceeds the size configured
+	// WithMaxFormSize.
+	RejectSize RejectReason = "size"
+	// RejectConcurrency denotes an append rejected because the queue of
+	// waiting appends was full, as configured WithAppendQueue.
+	RejectConcurrency RejectReason = "concurrency"
+	// RejectContent denotes a chunk whose leading bytes were rejected by the
+	// inspector configured WithAppendInspector.
+	RejectContent RejectReason = "content"
+	// RejectEmpty denotes a chunk without any bytes, as rejected when
+	// configured WithEmptyChunks(RejectEmptyChunks).
+	RejectEmpty RejectReason = "empty"
+)
+
+// EmptyChunkPolicy selects how appends of chunks without any bytes are
+// treated.
+type EmptyChunkPolicy int
+
+const (
+	// CountEmptyChunks treats empty chunks like any other chunk, so that
+	// they reset the timer of the upload.
+	CountEmptyChunks EmptyChunkPolicy = iota
+	// IgnoreEmptyChunks accepts empty chunks without treating them as
+	// activity, so that the timer of the upload continues to run as if the
+	// append had not happened.
+	IgnoreEmptyChunks
+	// RejectEmptyChunks rejects empty chunks with ErrEmptyChunk, without
+	// treating them as activity.
+	RejectEmptyChunks
+)
+
+// WithEmptyChunks configures how appends of chunks without any bytes are
+// treated. By default, they count as activity like other chunks, which lets a
+// client keep an upload alive indefinitely without sending any data; the
+// other policies prevent this. The policy applies to all appends except
+// AppendRange, whose ranges are never empty.
+func WithEmptyChunks[K Key](policy EmptyChunkPolicy) Option[K] {
+	return func(o *options[K]) {
+		o.emptyChunks = policy
+	}
+}
+
+// AppendInspector inspects the first bytes of an upload and returns an error
+// to reject it, for example when they indicate an archive whose compression
+// ratio suggests a decompression bomb.
+type AppendInspector func(head []byte) error
+
+// WithAppendInspector makes the scheduler call f with the leading bytes of
+// the first chunk appended to each upload, up to 3072 bytes, before anything
+// is written. If f returns an error, the chunk is rejected with
+// ErrRejectedContent, wrapping the error, and the upload remains empty. The
+// bytes read for inspection are written as part of the chunk, so the first
+// chunk is never transferred by the fast path described for AppendFrom.
+// Chunks appended by AppendRange are inspected if they start at offset zero.
+func WithAppendInspector[K Key](f AppendInspector) Option[K] {
+	return func(o *options[K]) {
+		o.inspector = f
+	}
+}
+
+// WithOnReject configures a hook that is called whenever a chunk is rejected
+// because it exceeds one of the limits of the scheduler, with the key of the
+// upload and the reason for the rejection, so that monitoring can count
+// rejections separately from failed appends. Rejections are also logged. The
+// hook is called synchronously by the rejected call, before its error is
+// returned, and must not block.
+func WithOnReject[K Key](f func(K, RejectReason)) Option[K] {
+	return func(o *options[K]) {
+		o.onReject = f
+	}
+}
+
+// Scanner scans finished uploads, for example for viruses using ClamAV.
+type Scanner interface {
+	// Scan scans the file specified by the given path and returns an error
+	// if it must be rejected.
+	Scan(path string) error
+}
+
+// WithScanner makes Finish and Flush scan each upload with s after its
+// destination has been closed. If the scan fails, the destination file is
+// removed and ErrScanFailed is returned, wrapping the error of the scan, and
+// no manifest is written. Scanning is synchronous, so Finish takes as long as
+// the scan. Only destinations that are *os.File can be scanned; other
+// destinations are not scanned.
+func WithScanner[K Key](s Scanner) Option[K] {
+	return func(o *options[K]) {
+		o.scanner = s
+	}
+}
+
+// WithChecksum makes the scheduler compute the SHA-256 checksum of each
+// upload incrementally while chunks are appended, which PartialChecksum
+// returns. Like WithManifest, which implies it, it keeps destinations from
+// being used as an io.ReaderFrom as described for AppendFrom.
+func WithChecksum[K Key]() Option[K] {
+	return func(o *options[K]) {
+		o.checksum = true
+	}
+}
+
+// WithManifest makes Finish write a JSON encoded Manifest of each upload to
+// the file whose path is returned by path for the upload's key, for example
+// next to its destination. The manifest is written after the destination is
+// closed, and is not written for uploads that expire or are finalized by
+// Close. Since the manifest includes the SHA-256 checksum of the upload, every
+// chunk is hashed while it is appended, so destinations are not used as an
+// io.ReaderFrom as described for AppendFrom.
+func WithManifest[K Key](path func(K) string) Option[K] {
+	return func(o *options[K]) {
+		o.manifestPath = path
+	}
+}
+
+// WithClock configures the function the scheduler uses to obtain the
+// current time when recording and evaluating the activity and deadlines of
+// uploads, which defaults to time.Now. Timers always use the system clock, so
+// this is mostly useful for testing time-based diagnostics and sweeping.
+func WithClock[K Key](now func() time.Time) Option[K] {
+	return func(o *options[K]) {
+		o.now = now
+	}
+}
+
+// WithLogger configures a logger to which the scheduler emits structured
+// records about prepared, appended, finished and timed out uploads. By
+// default, nothing is logged.
+func WithLogger[K Key](l *slog.Logger) Option[K] {
+	return func(o *options[K]) {
+		o.logger = l
+	}
+}
+
+// discardHandler is a slog.Handler that discards all records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
+
+// PrepareOption configures optional behavior of a single upload.
+type PrepareOption func(*prepareOptions)
+
+// prepareOptions holds the optional configuration of a single upload.
+type prepareOptions struct {
+	lifetime     time.Duration
+	group        string
+	groupTimeout time.Duration
+	warnAt       float64
+	warn         func(remaining time.Duration)
+	preallocate  int64
+}
+
+// WithLifetime limits the total duration of an upload. Unlike the timeout
+// passed to Prepare, which is an idle timeout restarted by every append, the
+// lifetime starts when the upload is prepared and is never extended. When it
+// ends, the upload is finalized and its timeout callback is called with an
+// error wrapping ErrLifetimeExceeded.
+func WithLifetime(d time.Duration) PrepareOption {
+	return func(o *prepareOptions) {
+		o.lifetime = d
+	}
+}
+
+// WithPreallocation declares the total size of the upload and makes Prepare
+// extend its destination to that size before anything is appended, which
+// reserves the space of the file up front and can reduce fragmentation of
+// large uploads. The file is extended with Truncate, so on most file systems
+// it is sparse until written. This only applies to destinations that are
+// *os.File created WithWriterFactory, which must not be opened in append mode,
+// as chunks are written from the start of the file over the reserved space;
+// the factories of this package satisfy this.
+//
+// When the upload is finished, the file is truncated to the number of bytes
+// written, removing any space that was reserved but not used. When it times
+// out or is canceled, the file is removed.
+func WithPreallocation(total int64) PrepareOption {
+	return func(o *prepareOptions) {
+		o.preallocate = total
+	}
+}
+
+// WithGroup adds the upload to the group with the given name, so that
+// related uploads, such as the files of a single submission, can be finished
+// or canceled together with FinishGroup and CancelGroup. The group is created
+// with the given timeout when its first member is prepared, and ends when its
+// last member is finalized. If the timeout is positive, it is an idle timeout
+// shared by all members and restarted by every append to any of them; when it
+// expires, all members are finalized at once and their timeout callbacks are
+// called with an error wrapping ErrGroupTimeout. The timeouts of the members
+// apply independently of the group.
+func WithGroup(name string, timeout time.Duration) PrepareOption {
+	return func(o *prepareOptions) {
+		o.group = name
+		o.groupTimeout = timeout
+	}
+}
+
+// WithExpiryWarning makes the scheduler call warn once an upload has been
+// idle for the given fraction of its timeout, for example 0.8, so that the
+// client can be notified before the upload expires. The upload is not
+// finalized; the warning is rearmed by every append, along with the timeout.
+// warn is passed the time remaining until the upload expires, and is invoked
+// like the timeout callback, so it runs on the callback workers if the
+// scheduler was configured WithCallbackWorkers. Fractions outside of the
+// range (0, 1) disable the warning.
+func WithExpiryWarning(fraction float64, warn func(remaining time.Duration)) PrepareOption {
+	return func(o *prepareOptions) {
+		o.warnAt = fraction
+		o.warn = warn
+	}
+}
+
+// disallowed reports whether the given MIME type is disallowed. Parameters
+// of the type are ignored.
+func (o options[K]) disallowed(t string) bool {
+	if mt, _, err := mime.ParseMediaType(t); err == nil {
+		t = mt
+	}
+	for _, d := range o.disallowedTypes {
+		if strings.EqualFold(d, t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package upsched
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// UploadStatus is a snapshot of the state of a single upload.
+type UploadStatus struct {
+	// BytesWritten is the number of bytes appended to the upload so far.
+	BytesWritten int64
+	// Timeout is the timeout duration the upload was prepared with.
+	Timeout time.Duration
+	// Remaining is the time left until the upload times out.
+	Remaining time.Duration
+	// Appends is the number of chunks successfully appended so far.
+	Appends int
+	// Total is the total size of the upload as declared by AppendRange, or
+	// -1 if it is unknown.
+	Total int64
+	// Created is the time at which the upload was prepared.
+	Created time.Time
+	// Age is the time elapsed since the upload was prepared, regardless of
+	// its activity.
+	Age time.Duration
+}
+
+// Complete reports whether the upload has a known total size and all of its
+// bytes have been written.
+func (s UploadStatus) Complete() bool {
+	return s.Total >= 0 && s.BytesWritten == s.Total
+}
+
+// MarshalJSON encodes the status as a JSON object with the fields
+// bytes_written, timeout_ms, remaining_ms, appends, total, created and
+// age_ms, where durations are expressed in whole milliseconds and created is
+// formatted as described by RFC 3339.
+func (s UploadStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		BytesWritten int64     `json:"bytes_written"`
+		TimeoutMS    int64     `json:"timeout_ms"`
+		RemainingMS  int64     `json:"remaining_ms"`
+		Appends      int       `json:"appends"`
+		Total        int64     `json:"total"`
+		Created      time.Time `json:"created"`
+		AgeMS        int64     `json:"age_ms"`
+	}{
+		BytesWritten: s.BytesWritten,
+		TimeoutMS:    s.Timeout.Milliseconds(),
+		RemainingMS:  s.Remaining.Milliseconds(),
+		Appends:      s.Appends,
+		Total:        s.Total,
+		Created:      s.Created,
+		AgeMS:        s.Age.Milliseconds(),
+	})
+}
+
+// SchedulerStats is a snapshot of aggregate statistics of a scheduler, as
+// returned by Stats. Active and BytesInFlight are gauges, while the other
+// fields are counters that only increase over the lifetime of the scheduler.
+type SchedulerStats struct {
+	// Active is the number of active uploads.
+	Active int
+	// BytesInFlight is the number of bytes appended to the active uploads so
+	// far.
+	BytesInFlight int64
+	// Appends is the number of chunks successfully appended.
+	Appends int64
+	// Timeouts is the number of uploads that expired, including those whose
+	// group or lifetime ran out, but not those that were canceled.
+	Timeouts int64
+	// Finishes is the number of uploads that were finished or flushed,
+	// including those whose finalization failed.
+	Finishes int64
+}
+
+// counters holds the counters reported by Stats, which are updated
+// atomically.
+type counters struct {
+	inFlight atomic.Int64
+	appends  atomic.Int64
+	timeouts atomic.Int64
+	finishes atomic.Int64
+}
+
+// Exists reports whether an upload with the given key has been prepared and
+// has not yet been finished. It does not affect the upload in any way.
+func (us *UploadScheduler[K]) Exists(k K) bool {
+	_, ok := us.m.Get(k)
+	return ok
+}
+
+// Len returns the number of active uploads.
+func (us *UploadScheduler[K]) Len() int {
+	return int(us.m.Len())
+}
+
+// Stats returns a snapshot of aggregate statistics of the scheduler, such as
+// for a metrics endpoint. The statistics are maintained atomically as uploads
+// progress, so Stats is cheap, but its fields are not read atomically as a
+// whole and may reflect concurrent operations in part.
+func (us *UploadScheduler[K]) Stats() SchedulerStats {
+	return SchedulerStats{
+		Active:        us.Len(),
+		BytesInFlight: us.counters.inFlight.Load(),
+		Appends:       us.counters.appends.Load(),
+		Timeouts:      us.counters.timeouts.Load(),
+		Finishes:      us.counters.finishes.Load(),
+	}
+}
+
+// Timeout returns the timeout duration the upload associated with the given
+// key was prepared with. Unlike Status, it does not compute anything. If the
+// key does not exist, an error is returned.
+func (us *UploadScheduler[K]) Timeout(k K) (time.Duration, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return 0, ErrKeyNotExist
+	}
+	return u.timeout, nil
+}
+
+// Age returns the time elapsed since the upload associated with the given
+// key was prepared, as measured by the clock configured WithClock. Unlike the
+// remaining time reported by Status, it does not depend on the activity of the
+// upload, which makes it suitable for audits and cleanup policies based on
+// the total duration of uploads. If the key does not exist, an error is
+// returned.
+func (us *UploadScheduler[K]) Age(k K) (time.Duration, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return 0, ErrKeyNotExist
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return max(us.opts.now().Sub(u.created), 0), nil
+}
+
+// PartialChecksum returns the SHA-256 checksum of the bytes written so far
+// to the upload associated with the given key, so that clients can verify
+// their progress before finishing the upload. It waits for an append in
+// progress to complete, so the checksum always covers whole chunks. If the
+// scheduler was not configured WithChecksum or WithManifest, ErrNoChecksum is
+// returned. If the key does not exist, an error is returned.
+func (us *UploadScheduler[K]) PartialChecksum(k K) ([]byte, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return nil, ErrKeyNotExist
+	}
+	if u.hash == nil {
+		return nil, ErrNoChecksum
+	}
+
+	u.appendMu.Lock()
+	defer u.appendMu.Unlock()
+
+	if u.finished {
+		return nil, ErrKeyNotExist
+	}
+	return u.hash.Sum(nil), nil
+}
+
+// Status returns a snapshot of the state of the upload associated with the
+// given key. If the key does not exist, an error is returned.
+func (us *UploadScheduler[K]) Status(k K) (UploadStatus, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return UploadStatus{}, ErrKeyNotExist
+	}
+
+	return u.status(us.opts.now()), nil
+}
+
+// Stuck returns the keys of all uploads whose last activity, which is the
+// completion of their last append or their preparation, lies further in the
+// past than the given threshold. Given a threshold well beyond the timeouts in
+// use, this reveals uploads that should have expired but did not, as well as
+// appends that hang.
+func (us *UploadScheduler[K]) Stuck(threshold time.Duration) []K {
+	now := us.opts.now()
+
+	var keys []K
+	us.m.ForEach(func(k K, u *upload) bool {
+		u.mu.Lock()
+		idle := now.Sub(u.active)
+		u.mu.Unlock()
+
+		if idle > threshold {
+			keys = append(keys, k)
+		}
+		return true
+	})
+
+	return keys
+}
+
+// ETA estimates the time remaining until the upload associated with the
+// given key reaches the given total size, based on its average throughput over
+// its recent appends. If totalSize is not positive, the total size declared to
+// AppendRange is used, and ErrUnknownSize is returned if there is none. Once
+// the total size has been reached, zero is returned. If no progress has been
+// made yet, ErrNoProgress is returned. If the key does not exist, an error is
+// returned.
+func (us *UploadScheduler[K]) ETA(k K, totalSize int64) (time.Duration, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return 0, ErrKeyNotExist
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if totalSize <= 0 {
+		if u.total < 0 {
+			return 0, ErrUnknownSize
+		}
+		totalSize = u.total
+	}
+
+	remaining := totalSize - u.written
+	if remaining <= 0 {
+		return 0, nil
+	}
+
+	first, last := u.samples[0], u.samples[len(u.samples)-1]
+	elapsed := last.at.Sub(first.at)
+	if last.written <= first.written || elapsed <= 0 {
+		return 0, ErrNoProgress
+	}
+
+	rate := float64(last.written-first.written) / float64(elapsed)
+	return time.Duration(float64(remaining) / rate), nil
+}
+
+// MarshalStatus returns the JSON encoding of the status of the upload
+// associated with the given key. If the key does not exist, an error is
+// returned.
+func (us *UploadScheduler[K]) MarshalStatus(k K) ([]byte, error) {
+	s, err := us.Status(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(s)
+}
+
+// Range calls f sequentially for each active upload with its key and a
+// snapshot of its state. If f returns false, Range stops the iteration.
+//
+// No lock is held while f is called, so f may safely call other methods of
+// the scheduler, including ones that prepare or finish uploads. Uploads
+// prepared or finished during the iteration may or may not be visited.
+func (us *UploadScheduler[K]) Range(f func(k K, s UploadStatus) bool) {
+	us.m.ForEach(func(k K, u *upload) bool {
+		return f(k, u.status(us.opts.now()))
+	})
+}
@@ -0,0 +1,59 @@
+package upsched
+
+import "time"
+
+// sweep periodically expires all uploads whose deadline has passed, until
+// the stop channel is closed. The timeout callbacks are invoked sequentially
+// from the sweeper's goroutine.
+func (us *UploadScheduler[K]) sweep(stop <-chan struct{}) {
+	t := time.NewTicker(us.opts.sweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+
+		us.sweepOnce(us.opts.now())
+	}
+}
+
+// sweepOnce expires the uploads that have expired at the given time and
+// issues the expiry warnings that are due, returning the number of uploads
+// expired.
+func (us *UploadScheduler[K]) sweepOnce(now time.Time) int {
+	var expired, warned []*upload
+	var reasons []error
+	us.m.ForEach(func(_ K, u *upload) bool {
+		if ok, reason := u.expired(now); ok {
+			expired = append(expired, u)
+			reasons = append(reasons, reason)
+		} else if u.warning(now, true) {
+			warned = append(warned, u)
+		}
+		return true
+	})
+
+	for _, u := range warned {
+		u.warn()
+	}
+	var n int
+	for i, u := range expired {
+		if u.expire(reasons[i]) {
+			n++
+		}
+	}
+	return n
+}
+
+// ExpireStale immediately expires all uploads whose deadline or lifetime has
+// passed according to the clock configured WithClock, as a sweeper would,
+// instead of waiting for their timers or the next sweep. Their timeout
+// callbacks are called as usual, and expiry warnings that are due are issued.
+// This is useful for administrative cleanups and for tests that advance the
+// clock. It returns the number of uploads expired.
+func (us *UploadScheduler[K]) ExpireStale() int {
+	return us.sweepOnce(us.opts.now())
+}
@@ -0,0 +1,94 @@
+package upsched
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// tokenPayload is the signed content of a resumption token. Created
+// identifies the upload the token was issued for, so that tokens do not apply
+// to later uploads with the same key.
+type tokenPayload[K Key] struct {
+	Key     K     `json:"k"`
+	Offset  int64 `json:"o"`
+	Created int64 `json:"c"`
+}
+
+// IssueToken returns a resumption token for the upload associated with the
+// given key, which lets a client that lost the key resume the upload. The
+// token embeds the key and the current offset of the upload, and is signed
+// with the given secret using HMAC-SHA256, so it cannot be forged without the
+// secret. If the key does not exist, an error is returned.
+func (us *UploadScheduler[K]) IssueToken(k K, secret []byte) (string, error) {
+	u, ok := us.m.Get(k)
+	if !ok {
+		return "", ErrKeyNotExist
+	}
+
+	u.mu.Lock()
+	p := tokenPayload[K]{Key: k, Offset: u.written, Created: u.created.UnixNano()}
+	u.mu.Unlock()
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode token: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(payload, secret)), nil
+}
+
+// ParseToken verifies a token issued by IssueToken with the given secret and
+// returns the key of the upload it was issued for, along with the upload's
+// current offset. It returns ErrInvalidToken if the token is malformed or has
+// been tampered with, and ErrTokenExpired if the upload it was issued for is
+// no longer active.
+func (us *UploadScheduler[K]) ParseToken(token string, secret []byte) (K, int64, error) {
+	var zero K
+
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return zero, 0, ErrInvalidToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, sign(payload, secret)) {
+		return zero, 0, ErrInvalidToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return zero, 0, ErrInvalidToken
+	}
+
+	var p tokenPayload[K]
+	if err := json.Unmarshal(b, &p); err != nil {
+		return zero, 0, ErrInvalidToken
+	}
+
+	u, ok := us.m.Get(p.Key)
+	if !ok {
+		return zero, 0, ErrTokenExpired
+	}
+
+	u.mu.Lock()
+	created, offset := u.created.UnixNano(), u.written
+	u.mu.Unlock()
+
+	if created != p.Created || offset < p.Offset {
+		return zero, 0, ErrTokenExpired
+	}
+
+	return p.Key, offset, nil
+}
+
+// sign returns the HMAC-SHA256 of the payload using the given secret.
+func sign(payload string, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
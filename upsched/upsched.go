@@ -5,11 +5,17 @@
 package upsched
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"log/slog"
 	"mime/multipart"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alphadose/haxmap"
@@ -20,6 +26,124 @@ const (
 	// AppendOpenFlags is the recommended flag set for opening a file to
 	// which chunks will be appended during the upload process.
 	AppendOpenFlags = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+
+	// sniffLen is the number of leading bytes of a chunk inspected when
+	// detecting its content type.
+	sniffLen = 3072
+)
+
+var (
+	// ErrKeyExists is returned when preparing an upload with a key that is
+	// already in use.
+	ErrKeyExists = errors.New("upload key already exists")
+
+	// ErrKeyNotExist is returned when operating on an upload whose key does
+	// not exist.
+	ErrKeyNotExist = errors.New("upload key does not exist")
+
+	// ErrDisallowedType is returned by AppendPart when the declared or
+	// detected content type of a chunk is disallowed.
+	ErrDisallowedType = errors.New("chunk content type is disallowed")
+
+	// ErrOffsetMismatch is returned by AppendRange when the start of a range
+	// does not match the current offset of the upload.
+	ErrOffsetMismatch = errors.New("range start does not match upload offset")
+
+	// ErrFinalizeClose is returned when closing the destination of an upload
+	// fails while it is finalized.
+	ErrFinalizeClose = errors.New("unable to close upload destination")
+
+	// ErrClosed is returned when preparing an upload on a closed scheduler.
+	ErrClosed = errors.New("scheduler is closed")
+
+	// ErrDraining is returned when preparing an upload on a draining
+	// scheduler.
+	ErrDraining = errors.New("scheduler is draining")
+
+	// ErrActiveUploads is returned by Reset when uploads are still active.
+	ErrActiveUploads = errors.New("scheduler has active uploads")
+
+	// ErrInvalidToken is returned by ParseToken when a token is malformed or
+	// its signature does not match.
+	ErrInvalidToken = errors.New("invalid resumption token")
+
+	// ErrTokenExpired is returned by ParseToken when the upload a token was
+	// issued for is no longer active.
+	ErrTokenExpired = errors.New("resumption token expired")
+
+	// ErrUnknownSize is returned by ETA when the total size of an upload is
+	// unknown.
+	ErrUnknownSize = errors.New("upload size is unknown")
+
+	// ErrNoProgress is returned by ETA when an upload has not made enough
+	// progress to estimate its throughput from.
+	ErrNoProgress = errors.New("no progress to estimate from")
+
+	// ErrTimeout is passed to the timeout callback of an upload that was
+	// finalized because no chunk was appended within its timeout.
+	ErrTimeout = errors.New("upload timed out")
+
+	// ErrLifetimeExceeded is passed to the timeout callback of an upload
+	// that was finalized because it exceeded its lifetime.
+	ErrLifetimeExceeded = errors.New("upload lifetime exceeded")
+
+	// ErrNilDestination is returned when appending to an upload without a
+	// destination, because neither the caller nor the scheduler provided
+	// one.
+	ErrNilDestination = errors.New("upload destination is nil")
+
+	// ErrDestinationClosed is returned when appending to a destination that
+	// has already been closed.
+	ErrDestinationClosed = errors.New("upload destination is closed")
+
+	// ErrMissingField is returned by AppendFromRequest when the request has
+	// no file in the given form field.
+	ErrMissingField = errors.New("form file field is missing")
+
+	// ErrFormTooLarge is returned by AppendFromRequest when the request body
+	// exceeds the size configured WithMaxFormSize.
+	ErrFormTooLarge = errors.New("multipart form is too large")
+
+	// ErrNoChecksum is returned by PartialChecksum when the scheduler does
+	// not compute checksums.
+	ErrNoChecksum = errors.New("upload checksums are not computed")
+
+	// ErrAppendQueueFull is returned when appending to an upload whose
+	// queue of waiting appends is full, as configured WithAppendQueue.
+	ErrAppendQueueFull = errors.New("upload append queue is full")
+
+	// ErrGroupTimeout is passed to the timeout callback of an upload that
+	// was finalized because its group timed out.
+	ErrGroupTimeout = errors.New("upload group timed out")
+
+	// ErrCanceled is passed to the timeout callback of an upload that was
+	// canceled.
+	ErrCanceled = errors.New("upload canceled")
+
+	// ErrInvalidMetadata is returned by ParseUploadMetadata when a header is
+	// malformed.
+	ErrInvalidMetadata = errors.New("invalid upload metadata")
+
+	// ErrRejectedContent is returned when the first bytes of an upload are
+	// rejected by the inspector configured WithAppendInspector.
+	ErrRejectedContent = errors.New("upload content rejected")
+
+	// ErrEmptyChunk is returned when appending a chunk without any bytes to
+	// a scheduler configured WithEmptyChunks(RejectEmptyChunks).
+	ErrEmptyChunk = errors.New("chunk is empty")
+
+	// ErrScanFailed is returned by Finish when the Scanner configured
+	// WithScanner rejects an upload.
+	ErrScanFailed = errors.New("upload rejected by scanner")
+
+	// ErrKeyType is returned by an AnyScheduler when a key does not have the
+	// key type of the wrapped UploadScheduler.
+	ErrKeyType = errors.New("key has the wrong type for scheduler")
+
+	// ErrSizeMismatch is returned by Finish when the scheduler was
+	// configured WithSizeCheck and the size of the destination file differs
+	// from the number of bytes written to the upload.
+	ErrSizeMismatch = errors.New("destination size does not match bytes written")
 )
 
 // Key defines the set of types that can be used as keys in the Scheduler.
@@ -30,104 +154,549 @@ type Key interface {
 
 // Scheduler manages the scheduling of multi-part uploads. It maintains
 // a map of active uploads and handles the appending of chunks, as well as
-// the automatic finalization of uploads based on a timeout.
+// the automatic finalization of uploads based on a timeout. The Scheduler
+// created by NewScheduler is an UploadScheduler, which provides many more
+// methods.
+//
+// The timeout passed to Prepare is given in seconds, even though its type is
+// time.Duration, so that a timeout of 30 means thirty seconds. The same
+// applies to PrepareBatch of UploadScheduler. All other durations, such as
+// those of WithLifetime and WithGroup and the ones reported by Status and
+// Timeout, are regular time.Duration values.
 type Scheduler[K Key] interface {
-	Prepare(k K, timeout time.Duration, cb func(K, error)) error
+	Prepare(k K, timeout time.Duration, cb func(K, error), opts ...PrepareOption) error
 	Append(k K, chunk multipart.File, dst io.Writer) error
 	Finish(k K) error
 }
 
 // upload holds the state for a single upload, including its timeout
-// duration and an associated timer.
+// duration, an associated timer and the progress made so far. The timer is
+// nil if the scheduler expires uploads using a sweeper instead. The mutex
+// guards all fields, while the append mutex is held for the duration of an
+// append so that appends to the same upload do not interleave.
 type upload struct {
-	timeout time.Duration
-	timer   *time.Timer
+	mu        sync.Mutex
+	appendMu  queueMutex
+	key       any
+	timeout   time.Duration
+	timer     *time.Timer
+	coalesce  time.Duration
+	rearmed   time.Time
+	lifetime  *time.Timer
+	group     string
+	expire    func(reason error) bool
+	warnTimer *time.Timer
+	warnAfter time.Duration
+	warn      func()
+	warned    bool
+	paused    bool
+	finished  bool
+	dst       io.Writer
+	last      any
+	prealloc  bool
+	hash      hash.Hash
+	created   time.Time
+	active    time.Time
+	deadline  time.Time
+	end       time.Time
+	written   int64
+	appends   int
+	total     int64
+	samples   []sample
 }
 
-// scheduler implements the Scheduler interface.
-type scheduler[K Key] struct {
-	m *haxmap.Map[K, upload]
+// sample records the number of bytes written to an upload at a point in
+// time.
+type sample struct {
+	at      time.Time
+	written int64
+}
+
+// etaWindow is the number of recent samples from which the throughput of an
+// upload is estimated.
+const etaWindow = 8
+
+// progress records the outcome of an append that wrote n bytes and failed
+// with err, if not nil, and resets the upload's timer. The caller must hold
+// the upload's mutex.
+func (u *upload) progress(n int64, err error, now time.Time) {
+	u.written += n
+	if err == nil {
+		u.appends++
+	}
+	u.samples = append(u.samples, sample{at: now, written: u.written})
+	if len(u.samples) > etaWindow {
+		u.samples = u.samples[len(u.samples)-etaWindow:]
+	}
+	u.reset(now)
 }
 
-// NewScheduler creates a new Scheduler. It returns a Scheduler configured to
-// manage uploads keyed by the specified type.
-func NewScheduler[K Key]() Scheduler[K] {
-	return scheduler[K]{
-		m: haxmap.New[K, upload](),
+// stop pauses the expiry of the upload until it is reset. The caller must
+// hold the upload's mutex.
+func (u *upload) stop() {
+	if u.timer != nil && u.coalesce <= 0 {
+		u.timer.Stop()
 	}
+	if u.warnTimer != nil {
+		u.warnTimer.Stop()
+	}
+	u.paused = true
+}
+
+// resume resumes the expiry of the upload after it was paused, without
+// recording any activity, so that it expires when it would have expired had
+// it not been paused. The caller must hold the upload's mutex.
+func (u *upload) resume(now time.Time) {
+	if u.timer != nil && u.coalesce <= 0 {
+		u.timer.Reset(max(u.deadline.Sub(now), 0))
+	}
+	if u.warnTimer != nil && !u.warned {
+		u.warnTimer.Reset(max(u.active.Add(u.warnAfter).Sub(now), 0))
+	}
+	u.paused = false
+}
+
+// reset restarts the upload's timer with its timeout duration, recording
+// the given time as the upload's last activity. The caller must hold the
+// upload's mutex.
+func (u *upload) reset(now time.Time) {
+	if u.timer != nil && (u.coalesce <= 0 || now.Sub(u.rearmed) >= u.coalesce) {
+		u.timer.Reset(u.timeout)
+		u.rearmed = now
+	}
+	if u.warnTimer != nil {
+		u.warnTimer.Reset(u.warnAfter)
+	}
+	u.warned = false
+	u.paused = false
+	u.active = now
+	u.deadline = now.Add(u.timeout)
+}
+
+// due reports whether the upload's timer firing at the given time should
+// expire the upload. If resets of the timer are coalesced and the upload is
+// paused or its deadline has not passed yet, the timer is rearmed instead.
+func (u *upload) due(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.coalesce <= 0 {
+		return true
+	}
+	if u.finished {
+		return false
+	}
+	if u.paused {
+		u.timer.Reset(u.timeout)
+		return false
+	}
+	if wait := u.deadline.Sub(now); wait > 0 {
+		u.timer.Reset(wait)
+		return false
+	}
+	return true
+}
+
+// expired reports whether the upload has expired at the given time, along
+// with the reason to pass to its expiry function. An upload expires when its
+// lifetime has ended, or when its deadline has passed while its expiry is not
+// paused.
+func (u *upload) expired(now time.Time) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.end.IsZero() && now.After(u.end) {
+		return true, ErrLifetimeExceeded
+	}
+	return !u.paused && now.After(u.deadline), nil
+}
+
+// warning reports whether the expiry warning of the upload is due, marking
+// it as issued so that it is issued once per period of inactivity. If
+// deadline is true, the warning is only due once the warning threshold has
+// passed at the given time; otherwise the caller's timer determines that.
+func (u *upload) warning(now time.Time, deadline bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.warn == nil || u.finished || u.paused || u.warned {
+		return false
+	}
+	if deadline && !now.After(u.active.Add(u.warnAfter)) {
+		return false
+	}
+	u.warned = true
+	return true
+}
+
+// expiry returns the time at which the upload expires unless it is reset.
+// The caller must hold the upload's mutex.
+func (u *upload) expiry() time.Time {
+	if !u.end.IsZero() && u.end.Before(u.deadline) {
+		return u.end
+	}
+	return u.deadline
+}
+
+// status returns a snapshot of the upload's state at the given time.
+func (u *upload) status(now time.Time) UploadStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return UploadStatus{
+		BytesWritten: u.written,
+		Timeout:      u.timeout,
+		Remaining:    max(u.expiry().Sub(now), 0),
+		Appends:      u.appends,
+		Total:        u.total,
+		Created:      u.created,
+		Age:          max(now.Sub(u.created), 0),
+	}
+}
+
+// UploadScheduler implements the Scheduler interface. Beyond the methods of
+// Scheduler, it provides further ways of appending chunks, finalizing and
+// canceling uploads, inspecting their progress, and managing the scheduler
+// itself. An UploadScheduler must be created by NewScheduler.
+type UploadScheduler[K Key] struct {
+	m         *haxmap.Map[K, *upload]
+	opts      options[K]
+	callbacks atomic.Pointer[callbackPool]
+
+	// The mutex guards the closed and draining states and the sweeper's
+	// stop channel; Prepare holds it for reading so that no upload is added
+	// while the scheduler closes or starts draining. The drain mutex guards
+	// the channel signaling that draining has completed.
+	mu        sync.RWMutex
+	closed    bool
+	draining  bool
+	stopSweep chan struct{}
+	drainMu   sync.Mutex
+	drained   chan struct{}
+	isDrained bool
+	groupsMu  sync.Mutex
+	groups    map[string]*group[K]
+	counters  counters
 }
 
-// Prepare initializes an upload with the given key and timeout duration.
+var _ Scheduler[string] = (*UploadScheduler[string])(nil)
+
+// NewScheduler creates a new Scheduler. It returns an UploadScheduler
+// configured to manage uploads keyed by the specified type, with optional
+// behavior configured by the given options.
+func NewScheduler[K Key](opts ...Option[K]) *UploadScheduler[K] {
+	us := &UploadScheduler[K]{
+		m: haxmap.New[K, *upload](),
+	}
+	for _, opt := range opts {
+		opt(&us.opts)
+	}
+	if us.opts.logger == nil {
+		us.opts.logger = slog.New(discardHandler{})
+	}
+	if us.opts.now == nil {
+		us.opts.now = time.Now
+	}
+	us.start()
+	return us
+}
+
+// start starts the sweeper and the callback workers, if configured. The
+// caller must hold the scheduler's mutex or have exclusive access to the
+// scheduler.
+func (us *UploadScheduler[K]) start() {
+	if us.opts.callbackWorkers > 0 {
+		us.callbacks.Store(newCallbackPool(us.opts.callbackWorkers))
+	}
+	if us.opts.sweepInterval > 0 {
+		us.stopSweep = make(chan struct{})
+		go us.sweep(us.stopSweep)
+	}
+}
+
+// Prepare initializes an upload with the given key and timeout in seconds.
 // If an upload with the specified key already exists, an error is returned.
 // The provided callback function is called with the key and an error if the
 // upload times out before it is finished. This function should be called
 // before any chunks are appended.
 //
+// The timeout is given in seconds, so that a timeout of 30 expires an idle
+// upload after thirty seconds. The converted duration is used for the
+// initial timer as well as for re-arming it after appends, and is the one
+// reported by Status and Timeout.
+//
 // If the upload is successfully initialized, a timer is started based on the
-// provided timeout duration. If the timer expires before the upload is
-// finished, the callback function is invoked.
+// provided timeout duration, unless the scheduler uses a sweeper. If the
+// timeout expires before the upload is finished, the upload is finalized and
+// the callback function is invoked with an error wrapping the cause of the
+// expiry, joined with the error of its finalization, if any. The cause is
+// ErrTimeout for an idle upload, ErrLifetimeExceeded for an upload limited
+// WithLifetime, ErrGroupTimeout for a member of a timed out group, and
+// ErrCanceled for a canceled upload. The callback is never called for uploads
+// finalized by Finish or Flush, so a finished upload is never reported as
+// timed out.
 //
-// Returns an error if the key already exists in the scheduler.
-func (us scheduler[K]) Prepare(k K, timeout time.Duration, cb func(K, error)) error {
+// Returns an error if the key already exists in the scheduler, ErrClosed if
+// the scheduler has been closed, or ErrDraining if it is draining.
+func (us *UploadScheduler[K]) Prepare(k K, timeout time.Duration, cb func(K, error), opts ...PrepareOption) error {
+	timeout = time.Second * time.Duration(timeout)
+
+	var po prepareOptions
+	for _, opt := range opts {
+		opt(&po)
+	}
+
+	if err := us.prepare(k, timeout, cb, po); err != nil {
+		return err
+	}
+
+	us.opts.logger.Debug("upload prepared", "key", k, "timeout", timeout, "lifetime", po.lifetime)
+
+	return nil
+}
+
+// prepare prepares an upload as described for Prepare, with the timeout
+// already converted, while holding the scheduler's mutex for reading.
+func (us *UploadScheduler[K]) prepare(k K, timeout time.Duration, cb func(K, error), po prepareOptions) error {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	if us.closed {
+		return ErrClosed
+	}
+	if us.draining {
+		return ErrDraining
+	}
+
 	_, ok := us.m.Get(k)
 	if ok {
-		return errors.New("upload key already exists")
+		return ErrKeyExists
 	}
 
-	d := time.Second * time.Duration(timeout)
+	var dst io.Writer
+	if us.opts.writerFactory != nil {
+		var err error
+		if dst, err = us.opts.writerFactory(k); err != nil {
+			return fmt.Errorf("unable to create upload destination: %w", err)
+		}
+	}
+
+	prealloc := false
+	if f, ok := dst.(*os.File); ok && po.preallocate > 0 {
+		if err := f.Truncate(po.preallocate); err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			return fmt.Errorf("unable to preallocate upload destination: %w", err)
+		}
+		prealloc = true
+	}
+
+	now := us.opts.now()
+	u := &upload{
+		key:      k,
+		timeout:  timeout,
+		created:  now,
+		active:   now,
+		deadline: now.Add(timeout),
+		total:    -1,
+		dst:      dst,
+		prealloc: prealloc,
+		group:    po.group,
+		samples:  []sample{{at: now}},
+	}
+	if prealloc {
+		u.total = po.preallocate
+	}
+
+	f := func(reason error) bool {
+		k, found, err := us.expireUpload(u)
+		if !found {
+			return false
+		}
 
-	f := func() {
-		if _, ok := us.m.Get(k); ok {
-			err := us.Finish(k)
-			cb(k, err)
+		if !errors.Is(reason, ErrCanceled) {
+			us.counters.timeouts.Add(1)
 		}
+		if errors.Is(reason, ErrCanceled) {
+			us.opts.logger.Info("upload canceled", "key", k)
+		} else if reason != nil {
+			us.opts.logger.Info("upload timed out", "key", k, "reason", reason)
+		} else {
+			us.opts.logger.Info("upload timed out", "key", k, "timeout", timeout)
+			reason = ErrTimeout
+		}
+
+		err = errors.Join(reason, err)
+		us.dispatch(func() { cb(k, err) })
+		return true
 	}
 
-	us.m.Set(
-		k,
-		upload{
-			timeout: timeout,
-			timer:   time.AfterFunc(d, f),
-		},
-	)
+	u.expire = f
+	if us.opts.checksum || us.opts.manifestPath != nil {
+		u.hash = sha256.New()
+	}
+	if po.lifetime > 0 {
+		u.end = now.Add(po.lifetime)
+	}
+	if po.warn != nil && po.warnAt > 0 && po.warnAt < 1 {
+		u.warnAfter = time.Duration(float64(timeout) * po.warnAt)
+		remaining := timeout - u.warnAfter
+		u.warn = func() {
+			u.mu.Lock()
+			k := u.key
+			u.mu.Unlock()
+			us.opts.logger.Debug("upload expiring soon", "key", k, "remaining", remaining)
+			us.dispatch(func() { po.warn(remaining) })
+		}
+	}
+	if us.opts.sweepInterval <= 0 {
+		u.coalesce = us.opts.coalesce
+		u.rearmed = now
+		u.mu.Lock()
+		u.timer = time.AfterFunc(timeout, func() {
+			if u.due(us.opts.now()) {
+				f(nil)
+			}
+		})
+		u.mu.Unlock()
+		if po.lifetime > 0 {
+			u.lifetime = time.AfterFunc(po.lifetime, func() { f(ErrLifetimeExceeded) })
+		}
+		if u.warn != nil {
+			u.warnTimer = time.AfterFunc(u.warnAfter, func() {
+				if u.warning(time.Time{}, false) {
+					u.warn()
+				}
+			})
+		}
+	}
+	if _, loaded := us.m.GetOrSet(k, u); loaded {
+		// Another upload with the same key was prepared concurrently.
+		u.mu.Lock()
+		u.stop()
+		if u.lifetime != nil {
+			u.lifetime.Stop()
+		}
+		u.finished = true
+		u.mu.Unlock()
+		discard(dst)
+		return ErrKeyExists
+	}
+	if po.group != "" {
+		us.join(po.group, po.groupTimeout, k)
+	}
 
 	return nil
 }
 
-// Append appends a chunk of data to the destination writer associated with
-// the given key. It resets the upload's timer to the initial timeout duration
-// upon a successful append. If the key does not exist, an error is returned.
-//
-// It is recommended to use AppendOpenFlags for actual files that are passed
-// to this function.
-func (us scheduler[K]) Append(k K, chunk multipart.File, dst io.Writer) error {
-	u, ok := us.m.Get(k)
-	if !ok {
-		return errors.New("upload key does not exist")
+// discard closes a destination created by the writer factory configured
+// WithWriterFactory for an upload that was never added to the scheduler, and
+// removes it if it is a file. Errors are ignored, since the destination was
+// never written to.
+func discard(dst io.Writer) {
+	if c, ok := dst.(io.Closer); ok {
+		_ = c.Close()
 	}
+	if f, ok := dst.(*os.File); ok {
+		_ = os.Remove(f.Name())
+	}
+}
 
-	u.timer.Stop()
-	defer u.timer.Reset(u.timeout)
+// PrepareBatch prepares uploads for all of the given keys with the same
+// timeout, callback and options, as if by Prepare. Like for Prepare, the
+// timeout is given in seconds. The batch is all or nothing: if any key
+// already exists or cannot be prepared otherwise, the uploads prepared by
+// this call are finalized again without invoking their callbacks, the files
+// created for them by the writer factory configured WithWriterFactory are
+// removed, and the error is returned. On success, it returns the prepared
+// keys.
+func (us *UploadScheduler[K]) PrepareBatch(keys []K, timeout time.Duration, cb func(K, error), opts ...PrepareOption) ([]K, error) {
+	prepared := make([]K, 0, len(keys))
+	for _, k := range keys {
+		if err := us.Prepare(k, timeout, cb, opts...); err != nil {
+			us.rollback(prepared)
+			return nil, fmt.Errorf("unable to prepare upload %v: %w", k, err)
+		}
+		prepared = append(prepared, k)
+	}
 
-	_, err := io.Copy(dst, chunk)
-	if err != nil {
-		return fmt.Errorf("unable to append chunk to destination file: %w", err)
+	return prepared, nil
+}
+
+// rollback discards the uploads prepared by a failed PrepareBatch without
+// invoking their callbacks, and removes the files created for them by the
+// writer factory.
+func (us *UploadScheduler[K]) rollback(keys []K) {
+	for _, k := range keys {
+		u, ok := us.m.Get(k)
+		if !ok {
+			continue
+		}
+
+		u.appendMu.Lock()
+		ok = us.remove(k, u)
+		u.appendMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		_ = us.complete(k, u, byClose)
+		if f, ok := u.dst.(*os.File); ok {
+			if err := os.Remove(f.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				us.opts.logger.Error("unable to remove upload destination", "key", k, "error", err)
+			}
+		}
 	}
+}
+
+// Rekey associates the upload associated with the old key with the new key
+// instead, for example to replace a provisional key with a permanent one once
+// the client has authenticated. The upload keeps its state, including its
+// timers and deadlines, the bytes written, its destination and its group, and
+// its timeout callback is called with the new key. It waits for an append in
+// progress to complete. Tokens issued by IssueToken for the old key are no
+// longer valid. If the old key does not exist, ErrKeyNotExist is returned,
+// and if the new key already exists, ErrKeyExists is returned.
+func (us *UploadScheduler[K]) Rekey(old, new K) error {
+	if err := us.rekey(old, new); err != nil {
+		return err
+	}
+
+	us.opts.logger.Debug("upload rekeyed", "key", old, "new_key", new)
 
 	return nil
 }
 
-// Finish finalizes the upload associated with the given key. It stops the
-// associated timer and removes the upload from the scheduler's internal map.
-// If the key does not exist, an error is returned.
-func (us scheduler[K]) Finish(k K) error {
-	u, ok := us.m.Get(k)
+// rekey rekeys an upload as described for Rekey while holding the
+// scheduler's mutex for reading and the upload's append lock.
+func (us *UploadScheduler[K]) rekey(old, new K) error {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	u, ok := us.m.Get(old)
 	if !ok {
-		return errors.New("upload key does not exist")
+		return ErrKeyNotExist
+	}
+
+	u.appendMu.Lock()
+	defer u.appendMu.Unlock()
+
+	u.mu.Lock()
+	if u.finished {
+		u.mu.Unlock()
+		return ErrKeyNotExist
 	}
+	if _, loaded := us.m.GetOrSet(new, u); loaded {
+		u.mu.Unlock()
+		return ErrKeyExists
+	}
+	us.m.Del(old)
+	u.key = new
+	u.mu.Unlock()
 
-	u.timer.Stop()
-	us.m.Del(k)
+	if u.group != "" {
+		us.regroup(u.group, old, new)
+	}
 
 	return nil
 }
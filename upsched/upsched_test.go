@@ -0,0 +1,2235 @@
+package upsched
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// memFile is an in-memory multipart.File.
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+// chunk returns a multipart.File with the given content.
+func chunk(s string) multipart.File {
+	return memFile{bytes.NewReader([]byte(s))}
+}
+
+// fileHeader returns the file header of a multipart form part of the given
+// field with the given declared content type and content.
+func fileHeader(t *testing.T, field, contentType string, content []byte) *multipart.FileHeader {
+	t.Helper()
+	body, boundary := formBody(t, field, contentType, content)
+	form, err := multipart.NewReader(body, boundary).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = form.RemoveAll() })
+	return form.File[field][0]
+}
+
+// formBody returns a multipart form body with a single file part of the
+// given field, along with its boundary.
+func formBody(t *testing.T, field, contentType string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename="upload.bin"`, field))
+	h.Set("Content-Type", contentType)
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, mw.Boundary()
+}
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+
+func noop(string, error) {}
+
+func TestAppendPartDisallowedTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		content     []byte
+		wantErr     error
+	}{
+		{"Allowed", "text/plain", []byte("hello"), nil},
+		{"Declared", "image/png; charset=binary", []byte("hello"), ErrDisallowedType},
+		{"Spoofed", "text/plain", pngHeader, ErrDisallowedType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := NewScheduler[string](WithDisallowedTypes[string]("IMAGE/PNG"))
+			if err := us.Prepare("a", 60, noop); err != nil {
+				t.Fatal(err)
+			}
+
+			var dst bytes.Buffer
+			err := us.AppendPart("a", fileHeader(t, "file", tt.contentType, tt.content), &dst)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AppendPart error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && dst.Len() != 0 {
+				t.Errorf("%d bytes written for a rejected chunk", dst.Len())
+			}
+			if tt.wantErr == nil && dst.String() != string(tt.content) {
+				t.Errorf("content = %q, want %q", dst.String(), tt.content)
+			}
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	us := NewScheduler[string]()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := us.Prepare(k, 60, noop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := us.Append("b", chunk("hello"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]UploadStatus)
+	us.Range(func(k string, s UploadStatus) bool {
+		seen[k] = s
+		// Finishing during the iteration must not deadlock.
+		return us.Finish(k) == nil
+	})
+
+	if len(seen) != 3 {
+		t.Fatalf("visited %d uploads, want 3", len(seen))
+	}
+	if s := seen["b"]; s.BytesWritten != 5 || s.Appends != 1 || s.Timeout != time.Minute {
+		t.Errorf("status of b = %+v", s)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := us.Status(k); err == nil {
+			t.Errorf("upload %q still exists after finishing it", k)
+		}
+	}
+
+	var n int
+	for _, k := range []string{"a", "b"} {
+		_ = us.Prepare(k, 60, noop)
+	}
+	us.Range(func(string, UploadStatus) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Range visited %d uploads after f returned false, want 1", n)
+	}
+}
+
+func TestMarshalStatus(t *testing.T) {
+	b, err := json.Marshal(UploadStatus{
+		BytesWritten: 5,
+		Timeout:      time.Minute,
+		Remaining:    50 * time.Second,
+		Appends:      1,
+		Total:        -1,
+		Created:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Age:          10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"bytes_written":5,"timeout_ms":60000,"remaining_ms":50000,"appends":1,"total":-1,"created":"2024-01-01T00:00:00Z","age_ms":10000}`
+	if string(b) != want {
+		t.Errorf("MarshalJSON = %s, want %s", b, want)
+	}
+
+	us := NewScheduler[string]()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	defer us.Finish("a")
+	if err := us.Append("a", chunk("hello"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	b, err = us.MarshalStatus("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["bytes_written"] != 5.0 || got["timeout_ms"] != 60000.0 || got["appends"] != 1.0 {
+		t.Errorf("MarshalStatus = %s", b)
+	}
+	if r, _ := got["remaining_ms"].(float64); r <= 0 || r > 60000 {
+		t.Errorf("remaining_ms = %v, want within (0, 60000]", got["remaining_ms"])
+	}
+
+	if _, err := us.MarshalStatus("b"); err == nil {
+		t.Error("MarshalStatus of a missing key succeeded")
+	}
+}
+
+func TestAppendRange(t *testing.T) {
+	us := NewScheduler[string]()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	defer us.Finish("a")
+
+	dst, err := os.CreateTemp(t.TempDir(), "range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := us.AppendRange("a", 0, 4, 10, strings.NewReader("hello"), dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.AppendRange("a", 3, 5, 10, strings.NewReader("xyz"), dst); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("overlapping range error = %v, want %v", err, ErrOffsetMismatch)
+	}
+	if err := us.AppendRange("a", 6, 9, 10, strings.NewReader("orld"), dst); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("gapped range error = %v, want %v", err, ErrOffsetMismatch)
+	}
+	if err := us.AppendRange("a", 5, 9, 11, strings.NewReader("world"), dst); err == nil {
+		t.Error("range with a changed total size accepted")
+	}
+	if err := us.AppendRange("a", 5, 10, 10, strings.NewReader("world!"), dst); err == nil {
+		t.Error("range beyond the total size accepted")
+	}
+	if err := us.AppendRange("a", 5, 9, 10, strings.NewReader("world"), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != "helloworld" {
+		t.Errorf("content = %q, want %q", got, "helloworld")
+	}
+	s, err := us.Status("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Complete() || s.Total != 10 {
+		t.Errorf("status = %+v, want complete with total 10", s)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := rate.NewLimiter(10000, 1000)
+	us := NewScheduler[string](WithLimiter[string](l))
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	defer us.Finish("a")
+
+	begin := time.Now()
+	var dst bytes.Buffer
+	if err := us.Append("a", memFile{bytes.NewReader(make([]byte, 3000))}, &dst); err != nil {
+		t.Fatal(err)
+	}
+	// The burst covers 1000 bytes, the other 2000 take 200ms.
+	if d := time.Since(begin); d < 150*time.Millisecond {
+		t.Errorf("append took %v, want at least 150ms", d)
+	}
+	if dst.Len() != 3000 {
+		t.Errorf("%d bytes written, want 3000", dst.Len())
+	}
+}
+
+func TestFinishAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option[string]
+		wantLeft bool
+	}{
+		{"StopsAtFailure", nil, true},
+		{"ContinueOnError", []Option[string]{WithContinueOnError[string]()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := NewScheduler[string](tt.opts...)
+			for _, k := range []string{"a", "c"} {
+				if err := us.Prepare(k, 60, noop); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer us.Finish("c")
+
+			if err := us.FinishAll([]string{"a", "b", "c"}); err == nil {
+				t.Fatal("FinishAll with a missing key succeeded")
+			}
+			if _, err := us.Status("a"); err == nil {
+				t.Error("upload preceding the failure not finished")
+			}
+			if _, err := us.Status("c"); (err == nil) != tt.wantLeft {
+				t.Errorf("upload following the failure exists = %v, want %v", err == nil, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	us := NewScheduler[string](WithLogger[string](logger))
+
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Append("a", chunk("hello"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Finish("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"upload prepared", "chunk appended", "upload finished"} {
+		if !strings.Contains(buf.String(), `msg="`+msg+`" key=a`) {
+			t.Errorf("log does not contain %q:\n%s", msg, buf.String())
+		}
+	}
+}
+
+var errFlaky = errors.New("flaky write")
+
+// flakyWriter fails its first write after writing two bytes.
+type flakyWriter struct {
+	bytes.Buffer
+	failed bool
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		w.failed = true
+		n, _ := w.Buffer.Write(p[:2])
+		return n, errFlaky
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestRetry(t *testing.T) {
+	retryable := func(err error) bool { return errors.Is(err, errFlaky) }
+
+	t.Run("Retried", func(t *testing.T) {
+		us := NewScheduler[string](WithRetry[string](2, time.Millisecond, time.Millisecond, retryable))
+		if err := us.Prepare("a", 60, noop); err != nil {
+			t.Fatal(err)
+		}
+		defer us.Finish("a")
+		var dst flakyWriter
+		if err := us.Append("a", chunk("hello world"), &dst); err != nil {
+			t.Fatal(err)
+		}
+		if got := dst.String(); got != "hello world" {
+			t.Errorf("content = %q, want %q", got, "hello world")
+		}
+	})
+
+	t.Run("NotRetried", func(t *testing.T) {
+		us := NewScheduler[string]()
+		if err := us.Prepare("a", 60, noop); err != nil {
+			t.Fatal(err)
+		}
+		defer us.Finish("a")
+		var dst flakyWriter
+		if err := us.Append("a", chunk("hello world"), &dst); !errors.Is(err, errFlaky) {
+			t.Errorf("Append error = %v, want %v", err, errFlaky)
+		}
+	})
+}
+
+func TestExists(t *testing.T) {
+	us := NewScheduler[string]()
+	if us.Exists("a") {
+		t.Error("unprepared upload exists")
+	}
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if !us.Exists("a") {
+		t.Error("prepared upload does not exist")
+	}
+	if err := us.Finish("a"); err != nil {
+		t.Fatal(err)
+	}
+	if us.Exists("a") {
+		t.Error("finished upload still exists")
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	us := NewScheduler[string](WithSweeper[string](10 * time.Millisecond))
+	expired := make(chan string, 1)
+	if err := us.Prepare("a", 1, func(k string, err error) {
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("timeout callback error = %v, want %v", err, ErrTimeout)
+		}
+		expired <- k
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case k := <-expired:
+		if k != "a" {
+			t.Errorf("expired %q, want %q", k, "a")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload not expired by the sweeper")
+	}
+	if us.Exists("a") {
+		t.Error("expired upload still exists")
+	}
+}
+
+func BenchmarkExpiry(b *testing.B) {
+	const uploads = 100_000
+	cb := func(int, error) {}
+
+	benchmarks := []struct {
+		name string
+		opts []Option[int]
+	}{
+		{"Timers", nil},
+		{"Sweeper", []Option[int]{WithSweeper[int](time.Second)}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				us := NewScheduler[int](bm.opts...)
+				for k := range uploads {
+					if err := us.Prepare(k, 60, cb); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for k := range uploads {
+					if err := us.Append(k, chunk("x"), io.Discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for k := range uploads {
+					if err := us.Finish(k); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// gateWriter is a writer whose first write blocks until the gate is opened.
+// It signals entered once the first write has started.
+type gateWriter struct {
+	bytes.Buffer
+	entered chan struct{}
+	gate    chan struct{}
+	once    sync.Once
+}
+
+func newGateWriter() *gateWriter {
+	return &gateWriter{entered: make(chan struct{}), gate: make(chan struct{})}
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	first := false
+	w.once.Do(func() { first = true })
+	if first {
+		close(w.entered)
+		<-w.gate
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestTryAppendBusy(t *testing.T) {
+	us := NewScheduler[string]()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	defer us.Finish("a")
+
+	dst := newGateWriter()
+	done := make(chan error)
+	go func() { done <- us.Append("a", chunk("a"), dst) }()
+	<-dst.entered
+
+	ok, err := us.TryAppend("a", chunk("b"), dst)
+	if ok || err != nil {
+		t.Errorf("TryAppend = %v, %v while busy, want false, nil", ok, err)
+	}
+
+	close(dst.gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	ok, err = us.TryAppend("a", chunk("b"), dst)
+	if !ok || err != nil {
+		t.Errorf("TryAppend = %v, %v while idle, want true, nil", ok, err)
+	}
+	if got := dst.String(); got != "ab" {
+		t.Errorf("content = %q, want %q", got, "ab")
+	}
+}
+
+func TestCallbackWorkersAreConcurrent(t *testing.T) {
+	// The sweeper expires both uploads in one pass. Each callback waits for
+	// the other, which only completes if they are dispatched to the workers
+	// instead of being invoked sequentially by the sweeper.
+	us := NewScheduler[string](WithSweeper[string](10*time.Millisecond), WithCallbackWorkers[string](2))
+
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	done := make(chan struct{}, 2)
+	cb := func(string, error) {
+		arrived.Done()
+		arrived.Wait()
+		done <- struct{}{}
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := us.Prepare(k, 1, cb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range 2 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout callbacks did not run concurrently")
+		}
+	}
+}
+
+// closeTracker is a destination that records whether it was closed.
+type closeTracker struct {
+	bytes.Buffer
+	closed bool
+	err    error
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return c.err
+}
+
+func TestFinishClosesManagedDestination(t *testing.T) {
+	errClose := errors.New("close failed")
+	for _, closeErr := range []error{nil, errClose} {
+		dst := &closeTracker{err: closeErr}
+		us := NewScheduler[string](WithWriterFactory(func(string) (io.Writer, error) { return dst, nil }))
+		if err := us.Prepare("a", 60, noop); err != nil {
+			t.Fatal(err)
+		}
+		if err := us.Append("a", chunk("hello"), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		err := us.Finish("a")
+		if closeErr == nil && err != nil {
+			t.Errorf("Finish error = %v", err)
+		}
+		if closeErr != nil && (!errors.Is(err, ErrFinalizeClose) || !errors.Is(err, errClose)) {
+			t.Errorf("Finish error = %v, want %v wrapping %v", err, ErrFinalizeClose, errClose)
+		}
+		if !dst.closed {
+			t.Error("managed destination not closed")
+		}
+		if dst.String() != "hello" {
+			t.Errorf("content = %q, want %q", dst.String(), "hello")
+		}
+		if us.Exists("a") {
+			t.Error("upload not removed")
+		}
+	}
+}
+
+func TestConcurrentPrepareClosesLosingDestination(t *testing.T) {
+	var mu sync.Mutex
+	var created []*closeTracker
+	us := NewScheduler[string](WithWriterFactory(func(string) (io.Writer, error) {
+		// The delay lets the other calls pass the check for an existing key.
+		time.Sleep(time.Millisecond)
+		dst := &closeTracker{}
+		mu.Lock()
+		created = append(created, dst)
+		mu.Unlock()
+		return dst, nil
+	}))
+	defer us.Close()
+
+	var wg sync.WaitGroup
+	var prepared atomic.Int32
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch err := us.Prepare("a", 60, noop); {
+			case err == nil:
+				prepared.Add(1)
+			case !errors.Is(err, ErrKeyExists):
+				t.Errorf("Prepare error = %v, want %v", err, ErrKeyExists)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := prepared.Load(); n != 1 {
+		t.Fatalf("%d concurrent calls prepared the upload, want 1", n)
+	}
+	open := 0
+	for _, dst := range created {
+		if !dst.closed {
+			open++
+		}
+	}
+	if open != 1 {
+		t.Errorf("%d of %d destinations left open, want only the prepared one", open, len(created))
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	us := NewScheduler[string]()
+	errs := make(chan error, 1)
+	begin := time.Now()
+	if err := us.Prepare("a", 60, func(_ string, err error) { errs <- err }, WithLifetime(200*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends keep the idle timeout from expiring, but do not extend the
+	// lifetime.
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrLifetimeExceeded) {
+				t.Errorf("callback error = %v, want %v", err, ErrLifetimeExceeded)
+			}
+			if d := time.Since(begin); d < 200*time.Millisecond {
+				t.Errorf("upload expired after %v, before its lifetime", d)
+			}
+			if us.Exists("a") {
+				t.Error("expired upload still exists")
+			}
+			return
+		case <-tick.C:
+			_ = us.Append("a", chunk("x"), io.Discard)
+		case <-time.After(5 * time.Second):
+			t.Fatal("upload not expired after its lifetime")
+		}
+	}
+}
+
+func TestAppendStream(t *testing.T) {
+	us := NewScheduler[string]()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, s := range []string{"ab", "cd", "ef"} {
+		pw, err := mw.CreateFormFile("chunk", "chunk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = pw.Write([]byte(s))
+	}
+	_ = mw.Close()
+
+	var dst bytes.Buffer
+	n, err := us.AppendStream("a", multipart.NewReader(&body, mw.Boundary()), &dst)
+	if err != nil || n != 3 {
+		t.Fatalf("AppendStream = %d, %v, want 3, nil", n, err)
+	}
+	if got := dst.String(); got != "abcdef" {
+		t.Errorf("content = %q, want %q", got, "abcdef")
+	}
+	if s, _ := us.Status("a"); s.Appends != 3 {
+		t.Errorf("appends = %d, want 3", s.Appends)
+	}
+}
+
+// fakeClock is a manually advanced clock for use WithClock.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestStuck(t *testing.T) {
+	clock := newFakeClock()
+	us := NewScheduler[string](WithClock[string](clock.Now))
+	for _, k := range []string{"a", "b"} {
+		if err := us.Prepare(k, 60, noop); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(10 * time.Minute)
+	if err := us.Append("b", chunk("x"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+
+	if got := us.Stuck(5 * time.Minute); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("Stuck = %v, want [a]", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Prepare("a", 60, noop); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Prepare error = %v on a closed scheduler, want %v", err, ErrClosed)
+	}
+	if err := us.Reset(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatalf("Prepare error = %v after Reset", err)
+	}
+
+	if err := us.Reset(false); !errors.Is(err, ErrActiveUploads) {
+		t.Errorf("Reset error = %v with active uploads, want %v", err, ErrActiveUploads)
+	}
+	if err := us.Reset(true); err != nil || us.Exists("a") {
+		t.Errorf("forced Reset = %v, upload exists = %v", err, us.Exists("a"))
+	}
+}
+
+// lockCheckHandler is a slog.Handler that records the messages of records
+// logged while the scheduler's mutex is held.
+type lockCheckHandler struct {
+	us     *UploadScheduler[string]
+	locked *[]string
+}
+
+func (h lockCheckHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h lockCheckHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h lockCheckHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h lockCheckHandler) Handle(_ context.Context, r slog.Record) error {
+	if h.us.mu.TryLock() {
+		h.us.mu.Unlock()
+	} else {
+		*h.locked = append(*h.locked, r.Message)
+	}
+	return nil
+}
+
+func TestNoLoggingWhileLocked(t *testing.T) {
+	var locked []string
+	h := &lockCheckHandler{locked: &locked}
+	us := NewScheduler[string](WithLogger[string](slog.New(h)), WithWriterFactory(func(string) (io.Writer, error) {
+		return &closeTracker{}, nil
+	}))
+	h.us = us
+
+	for _, k := range []string{"a", "b"} {
+		if err := us.Prepare(k, 60, noop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := us.Rekey("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Reset(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Prepare("d", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(locked) > 0 {
+		t.Errorf("logged while holding the scheduler's mutex: %q", locked)
+	}
+}
+
+// goroutinesSettle waits until the number of goroutines drops to at most n,
+// and returns the final number.
+func goroutinesSettle(n int) int {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+func TestCloseStopsCallbackWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for range 50 {
+		us := NewScheduler[string](WithCallbackWorkers[string](4), WithSweeper[string](time.Hour))
+		if err := us.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := goroutinesSettle(before); n > before {
+		t.Errorf("%d goroutines left after Close, want at most %d", n, before)
+	}
+}
+
+func TestCloseRunsQueuedCallbacks(t *testing.T) {
+	us := NewScheduler[int](WithCallbackWorkers[int](1), WithSweeper[int](10*time.Millisecond))
+
+	var done atomic.Int32
+	cb := func(int, error) {
+		time.Sleep(50 * time.Millisecond)
+		done.Add(1)
+	}
+	for k := range 3 {
+		if err := us.Prepare(k, 1, cb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); us.Exists(0) || us.Exists(1) || us.Exists(2); {
+		if time.Now().After(deadline) {
+			t.Fatal("uploads not expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := done.Load(); n != 3 {
+		t.Errorf("%d callbacks completed before Close returned, want 3", n)
+	}
+}
+
+func TestResetRestartsCallbackWorkers(t *testing.T) {
+	us := NewScheduler[string](WithCallbackWorkers[string](2))
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Reset(false); err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+
+	if p := us.callbacks.Load(); p == nil {
+		t.Error("callback workers not restarted by Reset")
+	}
+}
+
+func TestResumptionToken(t *testing.T) {
+	secret := []byte("secret")
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Append("a", chunk("hello"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := us.IssueToken("a", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, off, err := us.ParseToken(token, secret)
+	if err != nil || k != "a" || off != 5 {
+		t.Errorf("ParseToken = %q, %d, %v, want a, 5, nil", k, off, err)
+	}
+
+	if _, _, err := us.ParseToken(token, []byte("other")); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ParseToken error = %v with the wrong secret, want %v", err, ErrInvalidToken)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"k":"b","o":0,"c":0}`)) + "." + sig
+	if _, _, err := us.ParseToken(forged, secret); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ParseToken error = %v for a forged payload, want %v", err, ErrInvalidToken)
+	}
+	if _, _, err := us.ParseToken(payload, secret); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ParseToken error = %v without a signature, want %v", err, ErrInvalidToken)
+	}
+
+	if err := us.Finish("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := us.ParseToken(token, secret); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("ParseToken error = %v for a new upload with the same key, want %v", err, ErrTokenExpired)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if us.DrainedDone() != nil {
+		t.Error("DrainedDone is not nil before Drain")
+	}
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	us.Drain()
+	if err := us.Prepare("b", 60, noop); !errors.Is(err, ErrDraining) {
+		t.Errorf("Prepare error = %v while draining, want %v", err, ErrDraining)
+	}
+	if err := us.Append("a", chunk("x"), io.Discard); err != nil {
+		t.Errorf("Append error = %v while draining", err)
+	}
+
+	done := us.DrainedDone()
+	select {
+	case <-done:
+		t.Fatal("drained while an upload is active")
+	default:
+	}
+	if err := us.Finish("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("not drained after the last upload finished")
+	}
+}
+
+func TestMemWriter(t *testing.T) {
+	var mw MemWriter
+	_, _ = mw.Write([]byte("ab"))
+	_, _ = mw.WriteAt([]byte("z"), 4)
+	if got := mw.Bytes(); !bytes.Equal(got, []byte("ab\x00\x00z")) || mw.Len() != 5 {
+		t.Errorf("content = %q, want %q", got, "ab\x00\x00z")
+	}
+
+	b := mw.Bytes()
+	b[0] = 'x'
+	if mw.Bytes()[0] != 'a' {
+		t.Error("Bytes does not return a copy")
+	}
+	if _, err := mw.WriteAt([]byte("x"), -1); err == nil {
+		t.Error("WriteAt accepted a negative offset")
+	}
+}
+
+func TestETA(t *testing.T) {
+	clock := newFakeClock()
+	us := NewScheduler[string](WithClock[string](clock.Now))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := us.ETA("a", 0); !errors.Is(err, ErrUnknownSize) {
+		t.Errorf("ETA error = %v without a total size, want %v", err, ErrUnknownSize)
+	}
+	if _, err := us.ETA("a", 400); !errors.Is(err, ErrNoProgress) {
+		t.Errorf("ETA error = %v without progress, want %v", err, ErrNoProgress)
+	}
+
+	for range 2 {
+		clock.Advance(time.Second)
+		if err := us.Append("a", memFile{bytes.NewReader(make([]byte, 100))}, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d, err := us.ETA("a", 400); err != nil || d != 2*time.Second {
+		t.Errorf("ETA = %v, %v, want 2s", d, err)
+	}
+	if d, err := us.ETA("a", 200); err != nil || d != 0 {
+		t.Errorf("ETA = %v, %v once complete, want 0", d, err)
+	}
+}
+
+func TestPrepareBatchRollbackRemovesDestinations(t *testing.T) {
+	dir := t.TempDir()
+	us := NewScheduler[string](WithWriterFactory(func(k string) (io.Writer, error) {
+		return os.CreateTemp(dir, k)
+	}))
+	defer us.Close()
+
+	if err := us.Prepare("c", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := us.PrepareBatch([]string{"a", "b", "c"}, 60, noop); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("PrepareBatch error = %v, want %v", err, ErrKeyExists)
+	}
+	if us.Exists("a") || us.Exists("b") {
+		t.Error("uploads of the failed batch still exist")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the destination directory, want only the one of c", len(entries))
+	}
+
+	keys, err := us.PrepareBatch([]string{"a", "b"}, 60, noop)
+	if err != nil || !slices.Equal(keys, []string{"a", "b"}) {
+		t.Errorf("PrepareBatch = %v, %v, want [a b], nil", keys, err)
+	}
+}
+
+func TestAppendFrom(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	var dst MemWriter
+	for _, r := range []io.Reader{strings.NewReader("hello "), struct{ io.Reader }{strings.NewReader("world")}} {
+		if err := us.AppendFrom("a", r, &dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := string(dst.Bytes()); got != "hello world" {
+		t.Errorf("content = %q, want %q", got, "hello world")
+	}
+}
+
+// copyWriter is a writer that copies everything written to it into its
+// buffer, wrapping around at its end. It does not implement io.ReaderFrom.
+type copyWriter struct {
+	buf []byte
+	off int
+}
+
+func (w *copyWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		c := copy(w.buf[w.off:], p[n:])
+		n += c
+		w.off = (w.off + c) % len(w.buf)
+	}
+	return len(p), nil
+}
+
+func BenchmarkAppendFromWriterTo(b *testing.B) {
+	data := make([]byte, 16<<20)
+	dst := &copyWriter{buf: make([]byte, len(data))}
+
+	benchmarks := []struct {
+		name  string
+		chunk func() io.Reader
+	}{
+		{"WriterTo", func() io.Reader { return bytes.NewReader(data) }},
+		{"Copy", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(data)} }},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			us := NewScheduler[int]()
+			defer us.Close()
+			if err := us.Prepare(0, 60, func(int, error) {}); err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if err := us.AppendFrom(0, bm.chunk(), dst); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSizeCheck(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]*os.File)
+	us := NewScheduler[string](WithWriterFactory(func(k string) (io.Writer, error) {
+		f, err := os.Create(filepath.Join(dir, k))
+		files[k] = f
+		return f, err
+	}), WithSizeCheck[string]())
+	defer us.Close()
+
+	for _, k := range []string{"a", "b"} {
+		if err := us.Prepare(k, 60, noop); err != nil {
+			t.Fatal(err)
+		}
+		if err := us.Append(k, chunk("hello"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := us.Finish("a"); err != nil {
+		t.Errorf("Finish error = %v for a matching size", err)
+	}
+
+	f, err := os.OpenFile(files["b"].Name(), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("!"))
+	_ = f.Close()
+	if err := us.Finish("b"); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Finish error = %v for a modified file, want %v", err, ErrSizeMismatch)
+	}
+}
+
+func TestAnyScheduler(t *testing.T) {
+	s := NewScheduler[int]()
+	as := NewAnyScheduler(s)
+	defer as.Close()
+
+	if err := as.Prepare("a", 60, func(any, error) {}); !errors.Is(err, ErrKeyType) {
+		t.Errorf("Prepare error = %v for a string key, want %v", err, ErrKeyType)
+	}
+	if as.Exists("a") {
+		t.Error("Exists reported a key of the wrong type")
+	}
+
+	if err := as.Prepare(1, 60, func(any, error) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.AppendFrom(1, strings.NewReader("hello"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := as.Status(1); err != nil || st.BytesWritten != 5 {
+		t.Errorf("Status = %+v, %v", st, err)
+	}
+	if err := as.Finish(1); err != nil || s.Exists(1) {
+		t.Errorf("Finish = %v, upload exists = %v", err, s.Exists(1))
+	}
+}
+
+func TestExpiryWarning(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+
+	warnings := make(chan time.Duration, 2)
+	begin := time.Now()
+	if err := us.Prepare("a", 1, noop, WithExpiryWarning(0.5, func(remaining time.Duration) {
+		warnings <- remaining
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case remaining := <-warnings:
+		if d := time.Since(begin); d < 500*time.Millisecond {
+			t.Errorf("warned after %v, before the threshold", d)
+		}
+		if remaining <= 0 || remaining > 500*time.Millisecond {
+			t.Errorf("remaining = %v, want within (0, 500ms]", remaining)
+		}
+		if !us.Exists("a") {
+			t.Error("upload finalized by the warning")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no expiry warning")
+	}
+
+	time.Sleep(700 * time.Millisecond)
+	if len(warnings) != 0 {
+		t.Error("warned more than once for a single period of inactivity")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := func(k string) string { return filepath.Join(dir, k+".json") }
+	us := NewScheduler[string](WithManifest(manifest))
+	defer us.Close()
+
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := us.Append("a", chunk("hello"), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := us.Finish("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(manifest("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("hellohello"))
+	if m.Size != 10 || m.Chunks != 2 || m.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("manifest = %+v", m)
+	}
+
+	if err := us.Prepare("b", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(manifest("b")); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("manifest written for an upload finalized by Close")
+	}
+}
+
+func TestNilAndClosedDestination(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	var nilFile *os.File
+	if err := us.Append("a", chunk("x"), nil); !errors.Is(err, ErrNilDestination) {
+		t.Errorf("Append error = %v with a nil destination, want %v", err, ErrNilDestination)
+	}
+	if err := us.Append("a", chunk("x"), nilFile); !errors.Is(err, ErrNilDestination) {
+		t.Errorf("Append error = %v with a nil file, want %v", err, ErrNilDestination)
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if err := us.Append("a", chunk("x"), f); !errors.Is(err, ErrDestinationClosed) {
+		t.Errorf("Append error = %v with a closed file, want %v", err, ErrDestinationClosed)
+	}
+}
+
+func TestMultiScheduler(t *testing.T) {
+	var configured []string
+	ms := NewMultiScheduler[string, string](func(tenant string) []Option[string] {
+		configured = append(configured, tenant)
+		return nil
+	})
+	defer ms.Close()
+
+	for _, tenant := range []string{"x", "y"} {
+		if err := ms.Tenant(tenant).Prepare("a", 60, noop); err != nil {
+			t.Fatalf("Prepare for tenant %s: %v", tenant, err)
+		}
+	}
+	if ms.Tenant("x") != ms.Tenant("x") || len(configured) != 2 {
+		t.Error("tenant scheduler not reused")
+	}
+	if ms.Len() != 2 {
+		t.Errorf("Len = %d, want 2", ms.Len())
+	}
+
+	if err := ms.Remove("x"); err != nil {
+		t.Fatal(err)
+	}
+	if ms.Len() != 1 || ms.Tenant("x").Exists("a") {
+		t.Error("removed tenant still has uploads")
+	}
+}
+
+// callbackErrs records the errors passed to timeout callbacks by key.
+type callbackErrs struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (c *callbackErrs) cb(k string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.errs == nil {
+		c.errs = make(map[string]error)
+	}
+	c.errs[k] = err
+}
+
+func (c *callbackErrs) get(k string) (error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err, ok := c.errs[k]
+	return err, ok
+}
+
+func TestFlush(t *testing.T) {
+	var cbs callbackErrs
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, cbs.cb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := us.Flush("a"); err != nil {
+		t.Fatal(err)
+	}
+	if us.Exists("a") {
+		t.Error("upload not finalized")
+	}
+	if _, ok := cbs.get("a"); ok {
+		t.Error("callback called for a flushed upload")
+	}
+	if err := us.Flush("a"); !errors.Is(err, ErrKeyNotExist) {
+		t.Errorf("Flush error = %v, want %v", err, ErrKeyNotExist)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 30, noop); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := us.Timeout("a"); err != nil || d != 30*time.Second {
+		t.Errorf("Timeout = %v, %v, want 30s", d, err)
+	}
+	if _, err := us.Timeout("b"); !errors.Is(err, ErrKeyNotExist) {
+		t.Errorf("Timeout error = %v, want %v", err, ErrKeyNotExist)
+	}
+}
+
+func TestTimeoutUnits(t *testing.T) {
+	clock := newFakeClock()
+	var cbs callbackErrs
+	us := NewScheduler[string](WithClock[string](clock.Now), WithSweeper[string](time.Hour))
+	defer us.Close()
+
+	// The timeout is in seconds, the lifetime is a duration.
+	if err := us.Prepare("a", 30, cbs.cb, WithLifetime(45*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := us.Timeout("a"); err != nil || d != 30*time.Second {
+		t.Errorf("Timeout = %v, %v, want 30s", d, err)
+	}
+
+	clock.Advance(20 * time.Second)
+	if err := us.Append("a", chunk("x"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(20 * time.Second)
+	if n := us.ExpireStale(); n != 0 {
+		t.Fatalf("ExpireStale expired %d uploads within the timeout and lifetime, want 0", n)
+	}
+
+	clock.Advance(10 * time.Second)
+	if n := us.ExpireStale(); n != 1 {
+		t.Fatalf("ExpireStale expired %d uploads after the lifetime, want 1", n)
+	}
+	if err, _ := cbs.get("a"); !errors.Is(err, ErrLifetimeExceeded) {
+		t.Errorf("callback error = %v, want %v", err, ErrLifetimeExceeded)
+	}
+}
+
+func TestExistsDoesNotReset(t *testing.T) {
+	clock := newFakeClock()
+	us := NewScheduler[string](WithClock[string](clock.Now), WithSweeper[string](time.Hour))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(30 * time.Second)
+	if !us.Exists("a") || us.Exists("b") {
+		t.Fatal("Exists does not report the active uploads")
+	}
+	if d, err := us.Timeout("a"); err != nil || d != time.Minute {
+		t.Errorf("Timeout = %v, %v, want %v", d, err, time.Minute)
+	}
+	s, err := us.Status("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Remaining != 30*time.Second {
+		t.Errorf("remaining time = %v after Exists and Timeout, want 30s", s.Remaining)
+	}
+}
+
+func TestAppendFromRequest(t *testing.T) {
+	newRequest := func(t *testing.T, field string, content []byte) *http.Request {
+		body, boundary := formBody(t, field, "text/plain", content)
+		r := httptest.NewRequest(http.MethodPost, "/", body)
+		r.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+		return r
+	}
+
+	var reasons []RejectReason
+	us := NewScheduler[string](WithOnReject(func(_ string, r RejectReason) { reasons = append(reasons, r) }))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	var dst MemWriter
+	r := newRequest(t, "file", []byte("hello"))
+	if err := us.AppendFromRequest("a", r, "file", &dst, WithMaxMemory(1)); err != nil {
+		t.Fatal(err)
+	}
+	_ = r.MultipartForm.RemoveAll()
+	if got := string(dst.Bytes()); got != "hello" {
+		t.Errorf("content = %q, want %q", got, "hello")
+	}
+
+	r = newRequest(t, "other", []byte("hello"))
+	if err := us.AppendFromRequest("a", r, "file", &dst); !errors.Is(err, ErrMissingField) {
+		t.Errorf("AppendFromRequest error = %v, want %v", err, ErrMissingField)
+	}
+
+	r = newRequest(t, "file", make([]byte, 1024))
+	if err := us.AppendFromRequest("a", r, "file", &dst, WithMaxFormSize(512)); !errors.Is(err, ErrFormTooLarge) {
+		t.Errorf("AppendFromRequest error = %v, want %v", err, ErrFormTooLarge)
+	}
+	r = newRequest(t, "file", make([]byte, 1024))
+	r.ContentLength = -1
+	if err := us.AppendFromRequest("a", r, "file", &dst, WithMaxFormSize(512)); !errors.Is(err, ErrFormTooLarge) {
+		t.Errorf("AppendFromRequest error = %v with an unknown length, want %v", err, ErrFormTooLarge)
+	}
+	if !slices.Equal(reasons, []RejectReason{RejectSize, RejectSize}) {
+		t.Errorf("reject reasons = %v, want two of %s", reasons, RejectSize)
+	}
+	if dst.Len() != 5 {
+		t.Errorf("%d bytes written, want 5", dst.Len())
+	}
+}
+
+func TestGCOrphans(t *testing.T) {
+	dir := t.TempDir()
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("active", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	name := TempName[string](dir)
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{name("orphan"), name("active"), name("recent"), filepath.Join(dir, "other.part")} {
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if path != name("recent") {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	n, err := us.GCOrphans(dir, 30*time.Minute)
+	if err != nil || n != 1 {
+		t.Fatalf("GCOrphans = %d, %v, want 1, nil", n, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"other.part", "upsched-active.part", "upsched-recent.part"}
+	if !slices.Equal(names, want) {
+		t.Errorf("remaining files = %v, want %v", names, want)
+	}
+}
+
+func TestPartialChecksum(t *testing.T) {
+	us := NewScheduler[string](WithChecksum[string]())
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"hello ", "world"} {
+		if err := us.Append("a", chunk(s), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sum, err := us.PartialChecksum("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256([]byte("hello world")); !bytes.Equal(sum, want[:]) {
+		t.Errorf("checksum = %x, want %x", sum, want)
+	}
+
+	plain := NewScheduler[string]()
+	defer plain.Close()
+	if err := plain.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.PartialChecksum("a"); !errors.Is(err, ErrNoChecksum) {
+		t.Errorf("PartialChecksum error = %v, want %v", err, ErrNoChecksum)
+	}
+}
+
+func TestAppendsAreFIFO(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := us.m.Get("a")
+	waiting := func() int {
+		u.appendMu.mu.Lock()
+		defer u.appendMu.mu.Unlock()
+		return len(u.appendMu.waiters)
+	}
+
+	dst := newGateWriter()
+	errs := make(chan error, 6)
+	go func() { errs <- us.Append("a", chunk("0"), dst) }()
+	<-dst.entered
+
+	for i := 1; i <= 5; i++ {
+		go func() { errs <- us.Append("a", chunk(string(rune('0'+i))), dst) }()
+		for waiting() != i {
+			runtime.Gosched()
+		}
+	}
+
+	close(dst.gate)
+	for range 6 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := string(dst.Bytes()); got != "012345" {
+		t.Errorf("content = %q, want %q", got, "012345")
+	}
+}
+
+func TestAppendN(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := us.AppendN("a", chunk("hello"), io.Discard); err != nil || n != 5 {
+		t.Errorf("AppendN = %d, %v, want 5, nil", n, err)
+	}
+	if n, err := us.AppendN("b", chunk("hello"), io.Discard); !errors.Is(err, ErrKeyNotExist) || n != 0 {
+		t.Errorf("AppendN = %d, %v, want 0, %v", n, err, ErrKeyNotExist)
+	}
+}
+
+func TestNamedFileFactory(t *testing.T) {
+	dir := t.TempDir()
+	name := TempName[string](dir)
+	if got, want := name("a-b/c"), filepath.Join(dir, "upsched-a%2Db%2Fc.part"); got != want {
+		t.Errorf("TempName = %q, want %q", got, want)
+	}
+
+	shared := func(string) string { return filepath.Join(dir, "sub", "shared.part") }
+	us := NewScheduler[string](WithWriterFactory(NamedFileFactory(shared)))
+	defer us.Close()
+
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if path, ok := us.DestinationPath("a"); !ok || path != shared("a") {
+		t.Errorf("DestinationPath = %q, %v, want %q", path, ok, shared("a"))
+	}
+	if err := us.Prepare("b", 60, noop); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Prepare error = %v for a taken path, want %v", err, fs.ErrExist)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	t.Run("FinishGroup", func(t *testing.T) {
+		us := NewScheduler[string]()
+		defer us.Close()
+		for _, k := range []string{"a", "b"} {
+			if err := us.Prepare(k, 60, noop, WithGroup("g", 0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := us.Prepare("c", 60, noop); err != nil {
+			t.Fatal(err)
+		}
+		if err := us.FinishGroup("g"); err != nil {
+			t.Fatal(err)
+		}
+		if us.Exists("a") || us.Exists("b") || !us.Exists("c") {
+			t.Error("FinishGroup did not finish exactly the members of the group")
+		}
+	})
+
+	t.Run("CancelGroup", func(t *testing.T) {
+		var cbs callbackErrs
+		us := NewScheduler[string]()
+		defer us.Close()
+		for _, k := range []string{"a", "b"} {
+			if err := us.Prepare(k, 60, cbs.cb, WithGroup("g", 0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		us.CancelGroup("g")
+		for _, k := range []string{"a", "b"} {
+			if err, ok := cbs.get(k); !ok || !errors.Is(err, ErrCanceled) {
+				t.Errorf("callback of %s called with %v, %v, want %v", k, err, ok, ErrCanceled)
+			}
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		called := make(chan error, 2)
+		cb := func(_ string, err error) { called <- err }
+		us := NewScheduler[string]()
+		defer us.Close()
+		for _, k := range []string{"a", "b"} {
+			if err := us.Prepare(k, 60, cb, WithGroup("g", 20*time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for range 2 {
+			select {
+			case err := <-called:
+				if !errors.Is(err, ErrGroupTimeout) {
+					t.Errorf("callback error = %v, want %v", err, ErrGroupTimeout)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("group did not time out")
+			}
+		}
+	})
+}
+
+func TestCallbackWorkersAreAsynchronous(t *testing.T) {
+	us := NewScheduler[string](WithCallbackWorkers[string](1))
+	defer us.Close()
+
+	release := make(chan struct{})
+	called := make(chan error, 1)
+	cb := func(_ string, err error) {
+		<-release
+		called <- err
+	}
+	if err := us.Prepare("a", 60, cb); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel returns while the callback is still blocked.
+	if err := us.Cancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-called; !errors.Is(err, ErrCanceled) {
+		t.Errorf("callback error = %v, want %v", err, ErrCanceled)
+	}
+}
+
+func BenchmarkTinyAppends(b *testing.B) {
+	const appends = 10_000
+	data := make([]byte, 512)
+
+	benchmarks := []struct {
+		name string
+		opts []Option[int]
+	}{
+		{"Default", nil},
+		{"Coalesced", []Option[int]{WithCoalescedResets[int](100 * time.Millisecond)}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			us := NewScheduler[int](bm.opts...)
+			defer us.Close()
+
+			b.ReportAllocs()
+			for i := range b.N {
+				if err := us.Prepare(i, 60, func(int, error) {}); err != nil {
+					b.Fatal(err)
+				}
+				for range appends {
+					if err := us.Append(i, memFile{bytes.NewReader(data)}, io.Discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := us.Finish(i); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSetDestination(t *testing.T) {
+	var first, second MemWriter
+	us := NewScheduler[string](WithWriterFactory(func(string) (io.Writer, error) { return &first, nil }))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := us.Append("a", chunk("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.SetDestination("a", &second); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Append("a", chunk("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Bytes()) != "a" || string(second.Bytes()) != "b" {
+		t.Errorf("contents = %q, %q, want %q, %q", first.Bytes(), second.Bytes(), "a", "b")
+	}
+	if err := us.SetDestination("a", nil); !errors.Is(err, ErrNilDestination) {
+		t.Errorf("SetDestination error = %v, want %v", err, ErrNilDestination)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	clock := newFakeClock()
+	us := NewScheduler[string](WithClock[string](clock.Now), WithSweeper[string](time.Hour))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	var dst syncCounter
+	if err := us.Append("a", chunk("hello"), &dst); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(45 * time.Second)
+
+	if n, err := us.Checkpoint("a"); err != nil || n != 5 {
+		t.Errorf("Checkpoint = %d, %v, want 5, nil", n, err)
+	}
+	if dst.syncs != 1 {
+		t.Errorf("destination synced %d times, want 1", dst.syncs)
+	}
+	if s, _ := us.Status("a"); s.Remaining != time.Minute {
+		t.Errorf("remaining time = %v after Checkpoint, want 1m", s.Remaining)
+	}
+}
+
+// syncCounter is a destination that counts calls of Sync.
+type syncCounter struct {
+	MemWriter
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func TestOnReject(t *testing.T) {
+	var reasons []RejectReason
+	us := NewScheduler[string](
+		WithAppendQueue[string](1),
+		WithOnReject(func(_ string, r RejectReason) { reasons = append(reasons, r) }),
+	)
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := us.m.Get("a")
+
+	dst := newGateWriter()
+	errs := make(chan error, 2)
+	go func() { errs <- us.Append("a", chunk("a"), dst) }()
+	<-dst.entered
+	go func() { errs <- us.Append("a", chunk("b"), dst) }()
+	for {
+		u.appendMu.mu.Lock()
+		n := len(u.appendMu.waiters)
+		u.appendMu.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	if err := us.Append("a", chunk("c"), dst); !errors.Is(err, ErrAppendQueueFull) {
+		t.Errorf("Append error = %v with a full queue, want %v", err, ErrAppendQueueFull)
+	}
+	close(dst.gate)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slices.Equal(reasons, []RejectReason{RejectConcurrency}) {
+		t.Errorf("reject reasons = %v, want [%s]", reasons, RejectConcurrency)
+	}
+}
+
+func TestUploadMetadata(t *testing.T) {
+	md, err := ParseUploadMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==, is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md) != 2 || md["filename"] != "world_domination_plan.pdf" || md["is_confidential"] != "" {
+		t.Errorf("metadata = %v", md)
+	}
+	if got, want := FormatUploadMetadata(md), "filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential"; got != want {
+		t.Errorf("FormatUploadMetadata = %q, want %q", got, want)
+	}
+
+	for _, header := range []string{"a YQ==,a YQ==", "a !!!", "a\tb YQ==", "a,,b"} {
+		if _, err := ParseUploadMetadata(header); !errors.Is(err, ErrInvalidMetadata) {
+			t.Errorf("ParseUploadMetadata(%q) error = %v, want %v", header, err, ErrInvalidMetadata)
+		}
+	}
+	if md, err := ParseUploadMetadata(""); err != nil || len(md) != 0 {
+		t.Errorf("ParseUploadMetadata of an empty header = %v, %v", md, err)
+	}
+}
+
+func TestFinishWith(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	errPost := errors.New("post failed")
+	if err := us.FinishWith("a", func(string) error { return errPost }); !errors.Is(err, errPost) {
+		t.Errorf("FinishWith error = %v, want %v", err, errPost)
+	}
+	if !us.Exists("a") {
+		t.Fatal("upload finalized although post failed")
+	}
+
+	var ran bool
+	if err := us.FinishWith("a", func(string) error { ran = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !ran || us.Exists("a") {
+		t.Errorf("post ran = %v, upload exists = %v", ran, us.Exists("a"))
+	}
+}
+
+func TestAppendInspector(t *testing.T) {
+	errZip := errors.New("archives are not accepted")
+	var reasons []RejectReason
+	us := NewScheduler[string](
+		WithAppendInspector[string](func(head []byte) error {
+			if bytes.HasPrefix(head, []byte("PK")) {
+				return errZip
+			}
+			return nil
+		}),
+		WithOnReject(func(_ string, r RejectReason) { reasons = append(reasons, r) }),
+	)
+	defer us.Close()
+	for _, k := range []string{"a", "b"} {
+		if err := us.Prepare(k, 60, noop); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rejected, accepted MemWriter
+	err := us.Append("a", chunk("PK\x03\x04"), &rejected)
+	if !errors.Is(err, ErrRejectedContent) || !errors.Is(err, errZip) {
+		t.Errorf("Append error = %v, want %v wrapping %v", err, ErrRejectedContent, errZip)
+	}
+	if rejected.Len() != 0 {
+		t.Error("rejected chunk written")
+	}
+
+	for _, s := range []string{"hello ", "PK"} {
+		if err := us.Append("b", chunk(s), &accepted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := string(accepted.Bytes()); got != "hello PK" {
+		t.Errorf("content = %q, want %q", got, "hello PK")
+	}
+	if !slices.Equal(reasons, []RejectReason{RejectContent}) {
+		t.Errorf("reject reasons = %v, want [%s]", reasons, RejectContent)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	var cbs callbackErrs
+	us := NewScheduler[string]()
+	defer us.Close()
+	for _, k := range []string{"a", "c"} {
+		if err := us.Prepare(k, 60, cbs.cb, WithGroup("g", 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := us.Append("a", chunk("hello"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := us.Rekey("a", "c"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Rekey error = %v to an existing key, want %v", err, ErrKeyExists)
+	}
+	if err := us.Rekey("x", "y"); !errors.Is(err, ErrKeyNotExist) {
+		t.Errorf("Rekey error = %v from a missing key, want %v", err, ErrKeyNotExist)
+	}
+	if err := us.Rekey("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if us.Exists("a") {
+		t.Error("old key still exists")
+	}
+	if s, err := us.Status("b"); err != nil || s.BytesWritten != 5 {
+		t.Errorf("status of the new key = %+v, %v", s, err)
+	}
+	us.CancelGroup("g")
+	if err, ok := cbs.get("b"); !ok || !errors.Is(err, ErrCanceled) {
+		t.Errorf("callback called with %v, %v for the new key, want %v", err, ok, ErrCanceled)
+	}
+}
+
+func TestEmptyChunks(t *testing.T) {
+	tests := []struct {
+		policy        EmptyChunkPolicy
+		wantErr       error
+		wantAppends   int
+		wantRemaining time.Duration
+	}{
+		{CountEmptyChunks, nil, 1, time.Minute},
+		{IgnoreEmptyChunks, nil, 0, 20 * time.Second},
+		{RejectEmptyChunks, ErrEmptyChunk, 0, 20 * time.Second},
+	}
+	for _, tt := range tests {
+		clock := newFakeClock()
+		us := NewScheduler[string](WithClock[string](clock.Now), WithSweeper[string](time.Hour), WithEmptyChunks[string](tt.policy))
+		if err := us.Prepare("a", 60, noop); err != nil {
+			t.Fatal(err)
+		}
+
+		clock.Advance(40 * time.Second)
+		if err := us.Append("a", chunk(""), io.Discard); !errors.Is(err, tt.wantErr) {
+			t.Errorf("policy %d: Append error = %v, want %v", tt.policy, err, tt.wantErr)
+		}
+		s, _ := us.Status("a")
+		if s.Appends != tt.wantAppends || s.Remaining != tt.wantRemaining {
+			t.Errorf("policy %d: appends = %d, remaining = %v, want %d, %v", tt.policy, s.Appends, s.Remaining, tt.wantAppends, tt.wantRemaining)
+		}
+		_ = us.Close()
+	}
+}
+
+func TestAge(t *testing.T) {
+	clock := newFakeClock()
+	us := NewScheduler[string](WithClock[string](clock.Now))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(30 * time.Second)
+	if err := us.Append("a", chunk("x"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15 * time.Second)
+
+	if d, err := us.Age("a"); err != nil || d != 45*time.Second {
+		t.Errorf("Age = %v, %v, want 45s", d, err)
+	}
+	if s, _ := us.Status("a"); !s.Created.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("created = %v", s.Created)
+	}
+}
+
+func TestDestinationPath(t *testing.T) {
+	dir := t.TempDir()
+	us := NewScheduler[string](WithWriterFactory(TempFileFactory[string](dir)))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	path, ok := us.DestinationPath("a")
+	if !ok || filepath.Dir(path) != dir || !strings.HasPrefix(filepath.Base(path), "upsched-a-") {
+		t.Errorf("DestinationPath = %q, %v", path, ok)
+	}
+
+	plain := NewScheduler[string]()
+	defer plain.Close()
+	if err := plain.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Append("a", chunk("x"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain.DestinationPath("a"); ok {
+		t.Error("DestinationPath reported a path for a destination that is not a file")
+	}
+}
+
+func TestScanner(t *testing.T) {
+	errInfected := errors.New("infected")
+	dir := t.TempDir()
+	us := NewScheduler[string](
+		WithWriterFactory(TempFileFactory[string](dir)),
+		WithScanner[string](scannerFunc(func(path string) error {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(b, []byte("EICAR")) {
+				return errInfected
+			}
+			return nil
+		})),
+	)
+	defer us.Close()
+
+	for k, content := range map[string]string{"clean": "hello", "infected": "EICAR"} {
+		if err := us.Prepare(k, 60, noop); err != nil {
+			t.Fatal(err)
+		}
+		if err := us.Append(k, chunk(content), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clean, _ := us.DestinationPath("clean")
+	if err := us.Finish("clean"); err != nil {
+		t.Errorf("Finish error = %v for a clean upload", err)
+	}
+	if _, err := os.Stat(clean); err != nil {
+		t.Errorf("clean upload removed: %v", err)
+	}
+
+	infected, _ := us.DestinationPath("infected")
+	err := us.Finish("infected")
+	if !errors.Is(err, ErrScanFailed) || !errors.Is(err, errInfected) {
+		t.Errorf("Finish error = %v, want %v wrapping %v", err, ErrScanFailed, errInfected)
+	}
+	if _, err := os.Stat(infected); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("infected upload not removed: %v", err)
+	}
+}
+
+// scannerFunc adapts a function to a Scanner.
+type scannerFunc func(path string) error
+
+func (f scannerFunc) Scan(path string) error { return f(path) }
+
+func TestSweeperExpiry(t *testing.T) {
+	clock := newFakeClock()
+	var cbs callbackErrs
+	us := NewScheduler[string](WithClock[string](clock.Now), WithSweeper[string](time.Hour))
+	defer us.Close()
+	for _, k := range []string{"a", "b"} {
+		if err := us.Prepare(k, 60, cbs.cb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(45 * time.Second)
+	if err := us.Append("b", chunk("x"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+
+	if n := us.ExpireStale(); n != 1 {
+		t.Fatalf("ExpireStale expired %d uploads, want 1", n)
+	}
+	if err, ok := cbs.get("a"); !ok || !errors.Is(err, ErrTimeout) {
+		t.Errorf("callback of a called with %v, %v, want %v", err, ok, ErrTimeout)
+	}
+	if _, ok := cbs.get("b"); ok || !us.Exists("b") {
+		t.Error("upload with recent activity expired")
+	}
+	if n := us.ExpireStale(); n != 0 {
+		t.Errorf("second ExpireStale expired %d uploads, want 0", n)
+	}
+}
+
+func TestPreallocation(t *testing.T) {
+	dir := t.TempDir()
+	us := NewScheduler[string](WithWriterFactory(TempFileFactory[string](dir)))
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop, WithPreallocation(100)); err != nil {
+		t.Fatal(err)
+	}
+
+	path, _ := us.DestinationPath("a")
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 100 {
+		t.Fatalf("preallocated file = %v, %v, want 100 bytes", fi, err)
+	}
+	if err := us.Append("a", chunk("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Finish("a"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "hello" {
+		t.Errorf("finished file = %q, %v, want %q", b, err, "hello")
+	}
+}
+
+func TestPreallocatedExpiryWithSizeCheck(t *testing.T) {
+	dir := t.TempDir()
+	var f *os.File
+	factory := func(string) (io.Writer, error) {
+		var err error
+		f, err = os.CreateTemp(dir, "upload")
+		return f, err
+	}
+
+	tests := []struct {
+		name  string
+		close bool
+	}{
+		{"Open", false},
+		{"CloseFails", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := NewScheduler[string](WithWriterFactory(factory), WithSizeCheck[string]())
+			defer us.Close()
+
+			var cbErr error
+			cb := func(_ string, err error) { cbErr = err }
+			if err := us.Prepare("a", 60, cb, WithPreallocation(100)); err != nil {
+				t.Fatal(err)
+			}
+			if err := us.Append("a", chunk("hello"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if tt.close {
+				_ = f.Close()
+			}
+			if err := us.Cancel("a"); err != nil {
+				t.Fatal(err)
+			}
+
+			if errors.Is(cbErr, ErrSizeMismatch) {
+				t.Errorf("callback error = %v, want no size mismatch", cbErr)
+			}
+			if tt.close && !errors.Is(cbErr, ErrFinalizeClose) {
+				t.Errorf("callback error = %v, want %v", cbErr, ErrFinalizeClose)
+			}
+			if _, err := os.Stat(f.Name()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("preallocated file not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestCallbackReasons(t *testing.T) {
+	clock := newFakeClock()
+	var cbs callbackErrs
+	us := NewScheduler[string](WithClock[string](clock.Now), WithSweeper[string](time.Hour))
+	defer us.Close()
+	for _, k := range []string{"expired", "canceled"} {
+		if err := us.Prepare(k, 60, cbs.cb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := us.Cancel("canceled"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Cancel("canceled"); !errors.Is(err, ErrKeyNotExist) {
+		t.Errorf("second Cancel error = %v, want %v", err, ErrKeyNotExist)
+	}
+	clock.Advance(2 * time.Minute)
+	us.ExpireStale()
+
+	if err, _ := cbs.get("expired"); !errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+		t.Errorf("callback of the expired upload called with %v, want %v", err, ErrTimeout)
+	}
+	if err, _ := cbs.get("canceled"); !errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+		t.Errorf("callback of the canceled upload called with %v, want %v", err, ErrCanceled)
+	}
+}
+
+func TestAppendBytes(t *testing.T) {
+	us := NewScheduler[string]()
+	defer us.Close()
+	if err := us.Prepare("a", 60, noop); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	var dst MemWriter
+	if err := us.AppendBytes("a", data, &dst); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'j'
+	if got := string(dst.Bytes()); got != "hello" {
+		t.Errorf("content = %q, want %q", got, "hello")
+	}
+	if err := us.AppendBytes("b", data, &dst); !errors.Is(err, ErrKeyNotExist) {
+		t.Errorf("AppendBytes error = %v, want %v", err, ErrKeyNotExist)
+	}
+}
+
+func TestStats(t *testing.T) {
+	clock := newFakeClock()
+	us := NewScheduler[string](WithClock[string](clock.Now), WithSweeper[string](time.Hour))
+	defer us.Close()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := us.Prepare(k, 60, noop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"a", "b", "b"} {
+		if err := us.AppendBytes(k, []byte("hello"), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := us.Finish("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Cancel("c"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	if err := us.AppendBytes("b", []byte("x"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(45 * time.Second)
+	us.ExpireStale()
+
+	want := SchedulerStats{Active: 1, BytesInFlight: 11, Appends: 4, Timeouts: 1, Finishes: 1}
+	if got := us.Stats(); got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}